@@ -0,0 +1,241 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jaracil/ei"
+	. "github.com/jaracil/nexus/log"
+	"github.com/sirupsen/logrus"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Barriers and latches are stored on the barriers table. Their participants are kept on
+// the arrived field as tickets prefixed by their connid, so dbClean can remove them.
+// A barrier row is deleted when its last party arrives, releasing all of them at once.
+// A latch is owned by the session creating it and opens when counted down enough times,
+// forgetting its participants. Until then, the countdowns of ended sessions are undone.
+
+const (
+	BarrierKind = "barrier"
+	LatchKind   = "latch"
+)
+
+var barrierWaiters = &LockWaiters{&sync.Mutex{}, map[string]chan struct{}{}}
+
+// Wake up the local waiters of a barrier or latch when it changes
+func barrierTrack() {
+	defer exit("barrier change-feed error")
+	for retry := 0; retry < 10; retry++ {
+		iter, err := r.Table("barriers").
+			Changes(r.ChangesOpts{Squash: false}).
+			Map(func(c r.Term) interface{} {
+				return r.Branch(c.Field("old_val").Eq(nil), c.Field("new_val").Field("id"), c.Field("old_val").Field("id"))
+			}).
+			Run(db)
+		if err != nil {
+			Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Errorf("Error opening barrierTrack iterator")
+			time.Sleep(time.Second)
+			continue
+		}
+		retry = 0
+		for {
+			var barrier string
+			if !iter.Next(&barrier) {
+				Log.WithFields(logrus.Fields{
+					"error": iter.Err().Error(),
+				}).Errorf("Error processing barrierTrack feed")
+				iter.Close()
+				break
+			}
+			barrierWaiters.Wake(barrier)
+		}
+	}
+}
+
+// Wait until cond holds on the barrier row, the timeout expires or the session ends
+func (nc *NexusConn) barrierWait(id string, timeout float64, cond func(b ei.Ei) bool) (bool, error) {
+	var toutCh <-chan time.Time
+	if timeout > 0 {
+		toutCh = time.After(time.Duration(timeout * float64(time.Second)))
+	}
+	for {
+		wake := barrierWaiters.Wait(id)
+		cur, err := r.Table("barriers").Get(id).Run(db)
+		if err != nil {
+			return false, err
+		}
+		var b interface{}
+		err = cur.One(&b)
+		cur.Close()
+		if err != nil && err != r.ErrEmptyResult {
+			return false, err
+		}
+		if cond(ei.N(b)) {
+			return true, nil
+		}
+		select {
+		case <-wake:
+		case <-time.After(time.Second):
+		case <-toutCh:
+			return false, nil
+		case <-nc.context.Done():
+			return false, nil
+		}
+	}
+}
+
+func (nc *NexusConn) handleBarrierReq(req *JsonRpcReq) {
+	key := "barrier"
+	if req.Method != "sync.barrier" {
+		key = "latch"
+	}
+	id, err := ei.N(req.Params).M(key).Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+	if err != nil {
+		req.Error(ErrInvalidParams, key, nil)
+		return
+	}
+	tags := nc.getTags(id)
+	if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+		req.Error(ErrPermissionDenied, "", nil)
+		return
+	}
+	timeout := ei.N(req.Params).M("timeout").Float64Z()
+
+	switch req.Method {
+	case "sync.barrier":
+		parties, err := ei.N(req.Params).M("parties").Int()
+		if err != nil || parties <= 0 {
+			req.Error(ErrInvalidParams, "parties", nil)
+			return
+		}
+		if parties == 1 {
+			req.Result(ei.M{"ok": true})
+			return
+		}
+		ticket := nc.connId + safeId(10)
+		res, err := r.Table("barriers").
+			Get(id).
+			Replace(func(b r.Term) interface{} {
+				return r.Branch(b.Eq(nil), ei.M{"id": id, "kind": BarrierKind, "parties": parties, "arrived": ei.S{ticket}},
+					b.Field("kind").Ne(BarrierKind), b,
+					b.Field("arrived").Count().Add(1).Ge(b.Field("parties")), nil,
+					b.Merge(ei.M{"arrived": b.Field("arrived").Append(ticket)}))
+			}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, err.Error(), nil)
+			return
+		}
+		if res.Unchanged > 0 {
+			req.Error(ErrInvalidParams, "barrier", nil)
+			return
+		}
+		if res.Deleted > 0 {
+			req.Result(ei.M{"ok": true})
+			return
+		}
+		ok, err := nc.barrierWait(id, timeout, func(b ei.Ei) bool {
+			for _, t := range b.M("arrived").SliceZ() {
+				if t == ticket {
+					return false
+				}
+			}
+			return true
+		})
+		if err == nil && !ok {
+			// Leave the barrier, unless it was released in the meantime
+			var wres r.WriteResponse
+			wres, err = r.Table("barriers").
+				Get(id).
+				Replace(func(b r.Term) interface{} {
+					arrived := b.Field("arrived").Default(ei.S{}).SetDifference(ei.S{ticket})
+					return r.Branch(b.Eq(nil), nil,
+						arrived.IsEmpty(), nil,
+						b.Merge(ei.M{"arrived": arrived}))
+				}).
+				RunWrite(db, r.RunOpts{Durability: "hard"})
+			ok = wres.Replaced+wres.Deleted == 0
+		}
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		if !ok {
+			req.Error(ErrTimeout, "", nil)
+			return
+		}
+		req.Result(ei.M{"ok": true})
+
+	case "sync.latch":
+		count, err := ei.N(req.Params).M("count").Int()
+		if err != nil || count <= 0 {
+			req.Error(ErrInvalidParams, "count", nil)
+			return
+		}
+		res, err := r.Table("barriers").
+			Insert(ei.M{"id": id, "kind": LatchKind, "owner": nc.connId, "count": count, "arrived": ei.S{}, "open": false},
+				r.InsertOpts{Conflict: func(_, old, _ r.Term) interface{} { return old }, ReturnChanges: "always"}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil || len(res.Changes) <= 0 {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		// Creating an existing latch is a no-op when its count matches
+		if old := ei.N(res.Changes[0].OldValue); res.Changes[0].OldValue != nil &&
+			(old.M("kind").StringZ() != LatchKind || old.M("count").IntZ() != count) {
+			req.Error(ErrInvalidParams, "latch already exists", ei.M{"kind": old.M("kind").StringZ(), "count": old.M("count").IntZ()})
+			return
+		}
+		req.Result(ei.M{"ok": true})
+
+	case "sync.countDown":
+		ticket := nc.connId + safeId(10)
+		res, err := r.Table("barriers").
+			Get(id).
+			Replace(func(b r.Term) interface{} {
+				arrived := b.Field("arrived").Append(ticket)
+				open := arrived.Count().Ge(b.Field("count"))
+				return r.Branch(b.Eq(nil), nil,
+					b.Field("kind").Ne(LatchKind).Or(b.Field("open")), b,
+					b.Merge(ei.M{"arrived": r.Branch(open, ei.S{}, arrived), "open": open}))
+			}, r.ReplaceOpts{ReturnChanges: "always"}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, err.Error(), nil)
+			return
+		}
+		if len(res.Changes) <= 0 || res.Changes[0].NewValue == nil || ei.N(res.Changes[0].NewValue).M("kind").StringZ() != LatchKind {
+			req.Error(ErrInvalidParams, "latch", nil)
+			return
+		}
+		latch := ei.N(res.Changes[0].NewValue)
+		remaining := latch.M("count").IntZ() - len(latch.M("arrived").SliceZ())
+		if remaining < 0 || latch.M("open").BoolZ() {
+			remaining = 0
+		}
+		req.Result(ei.M{"ok": true, "remaining": remaining})
+
+	case "sync.await":
+		exists := true
+		ok, err := nc.barrierWait(id, timeout, func(b ei.Ei) bool {
+			exists = b.M("kind").StringZ() == LatchKind
+			return !exists || b.M("open").BoolZ()
+		})
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		if !exists {
+			req.Error(ErrInvalidParams, "latch", nil)
+			return
+		}
+		if !ok {
+			req.Error(ErrTimeout, "", nil)
+			return
+		}
+		req.Result(ei.M{"ok": true})
+	}
+}
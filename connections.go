@@ -40,12 +40,14 @@ type JsonRpcRes struct {
 	Result  interface{} `json:"result,omitempty"`
 	Error   *JsonRpcErr `json:"error,omitempty"`
 
-	req *JsonRpcReq
+	req   *JsonRpcReq
+	notif *JsonRpcReq
 }
 
 type NexusConn struct {
 	conn      net.Conn
 	proto     string
+	remote    string // Address of the client, which is not the one of conn on the http listener
 	connRx    *smartio.SmartReader
 	connTx    *smartio.SmartWriter
 	connId    string
@@ -63,6 +65,7 @@ func NewNexusConn(conn net.Conn) *NexusConn {
 	nc := &NexusConn{
 		conn:   conn,
 		proto:  "unknown",
+		remote: conn.RemoteAddr().String(),
 		connRx: smartio.NewSmartReader(conn),
 		connTx: smartio.NewSmartWriter(conn),
 		connId: nodeId + safeId(4),
@@ -152,7 +155,7 @@ func (nc *NexusConn) logRes(res *JsonRpcRes) {
 		})
 		switch res.req.Method {
 		// Do not log verbose actions
-		case "pipe.read", "pipe.write", "sys.ping":
+		case "pipe.read", "pipe.write", "pipe.ack", "sys.ping":
 			if !LogLevelIs(DebugLevel) {
 				return
 			}
@@ -197,11 +200,11 @@ func (nc *NexusConn) logReq(req *JsonRpcReq) {
 		switch req.Method {
 
 		// Hide sensible parameters
-		case "sys.login", "user.setPass":
+		case "sys.login", "user.setPass", "pipe.attach":
 			e = e.WithField("params", make(map[string]interface{}))
 
 		// Do not log verbose actions
-		case "pipe.read", "pipe.write", "sys.ping":
+		case "pipe.read", "pipe.write", "pipe.ack", "sys.ping":
 			if !LogLevelIs(DebugLevel) {
 				return
 			}
@@ -222,6 +225,11 @@ func (nc *NexusConn) pushRes(res *JsonRpcRes) (err error) {
 	return
 }
 
+// Send a JSON-RPC notification to the client
+func (nc *NexusConn) pushNotif(method string, params interface{}) error {
+	return nc.pushRes(&JsonRpcRes{notif: &JsonRpcReq{Method: method, Params: params}})
+}
+
 func (nc *NexusConn) pullRes() (res *JsonRpcRes, err error) {
 	select {
 	case res = <-nc.chRes:
@@ -295,6 +303,10 @@ func (nc *NexusConn) handleReq(req *JsonRpcReq) {
 		nc.handleUserReq(req)
 	case strings.HasPrefix(req.Method, "sync."):
 		nc.handleSyncReq(req)
+	case strings.HasPrefix(req.Method, "kv."):
+		nc.handleKvReq(req)
+	case strings.HasPrefix(req.Method, "counter."):
+		nc.handleCounterReq(req)
 
 	default:
 		req.Error(ErrMethodNotFound, "", nil)
@@ -396,21 +408,27 @@ func (nc *NexusConn) sendWorker() {
 			}).Debugf("Error on sendWorker")
 			break
 		}
-		if res.Id == nil {
-			if res.Error == nil {
-				continue //Skip notification responses
+		var msg interface{} = res
+		if res.notif != nil {
+			res.notif.Jsonrpc = "2.0"
+			msg = res.notif
+		} else {
+			if res.Id == nil {
+				if res.Error == nil {
+					continue //Skip notification responses
+				}
+				if res.Error.Code == ErrInvalidRequest || res.Error.Code == ErrParse {
+					res.Id = null
+				} else {
+					continue
+				}
 			}
-			if res.Error.Code == ErrInvalidRequest || res.Error.Code == ErrParse {
-				res.Id = null
-			} else {
-				continue
+			res.Jsonrpc = "2.0"
+			if res.Result == nil && res.Error == nil {
+				res.Result = null
 			}
 		}
-		res.Jsonrpc = "2.0"
-		if res.Result == nil && res.Error == nil {
-			res.Result = null
-		}
-		buf, err := json.Marshal(res)
+		buf, err := json.Marshal(msg)
 		if err != nil {
 			nc.log.WithFields(logrus.Fields{
 				"connid": nc.connId,
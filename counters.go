@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/jaracil/ei"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Counters are increased atomically on the counters table. Counters with a window
+// start again from zero once it's over, which is counted from their first increment.
+// Their values are integers kept within the range the database stores exactly, as its numbers are doubles.
+
+const _counterMaxValue = 1<<53 - 1
+
+// Delete the counters whose window is over
+func counterPurge() {
+	defer exit("counter purge goroutine error")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if isMasterNode() {
+				r.Table("counters").
+					Between(r.MinVal, r.Now(), r.BetweenOpts{Index: "expires"}).
+					Delete().
+					RunWrite(db, r.RunOpts{Durability: "soft"})
+			}
+		case <-mainContext.Done():
+			return
+		}
+	}
+}
+
+// Return whether the counter row does not exist or its window is over
+func counterGone(c r.Term) r.Term {
+	return c.Eq(nil).Or(c.Field("expires").Default(r.MaxVal).Le(r.Now()))
+}
+
+func counterResult(row interface{}) ei.M {
+	c := ei.N(row)
+	res := ei.M{"counter": c.M("id").StringZ(), "value": c.M("value").Int64Z()}
+	if expires := c.M("expires").RawZ(); expires != nil {
+		res["expires"] = expires
+	}
+	return res
+}
+
+func (nc *NexusConn) handleCounterReq(req *JsonRpcReq) {
+	counter, err := ei.N(req.Params).M("counter").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+	if err != nil {
+		req.Error(ErrInvalidParams, "counter", nil)
+		return
+	}
+	tags := nc.getTags(counter)
+	if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+		req.Error(ErrPermissionDenied, "", nil)
+		return
+	}
+
+	switch req.Method {
+	case "counter.incr":
+		by := int64(1)
+		if ei.N(req.Params).HasKeyZ("by") {
+			f, err := ei.N(req.Params).M("by").Float64()
+			if err != nil || f != math.Trunc(f) || math.Abs(f) > _counterMaxValue {
+				req.Error(ErrInvalidParams, "by", nil)
+				return
+			}
+			by = int64(f)
+		}
+		row := ei.M{"id": counter, "value": by}
+		if window := ei.N(req.Params).M("window").Float64Z(); window > 0 {
+			row["window"] = window
+			row["expires"] = r.Now().Add(window)
+		}
+		res, err := r.Table("counters").
+			Get(counter).
+			Replace(func(c r.Term) interface{} {
+				value := c.Field("value").Add(by)
+				return r.Branch(counterGone(c), row,
+					value.Gt(_counterMaxValue).Or(value.Lt(-_counterMaxValue)), c,
+					c.Merge(ei.M{"value": value}))
+			}, r.ReplaceOpts{ReturnChanges: true}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, err.Error(), nil)
+			return
+		}
+		if len(res.Changes) <= 0 {
+			if by != 0 {
+				// The counter would leave the range stored exactly
+				req.Error(ErrInvalidParams, "by", nil)
+				return
+			}
+			// Adding zero to a live counter leaves it unchanged
+			nc.counterGet(req, counter)
+			return
+		}
+		req.Result(counterResult(res.Changes[0].NewValue))
+
+	case "counter.get":
+		nc.counterGet(req, counter)
+
+	case "counter.reset":
+		res, err := r.Table("counters").
+			Get(counter).
+			Delete().
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, err.Error(), nil)
+			return
+		}
+		req.Result(ei.M{"ok": true, "reset": res.Deleted > 0})
+
+	default:
+		req.Error(ErrMethodNotFound, "", nil)
+	}
+}
+
+func (nc *NexusConn) counterGet(req *JsonRpcReq, counter string) {
+	c := r.Table("counters").Get(counter)
+	cur, err := r.Branch(counterGone(c), nil, c).Run(db)
+	if err != nil {
+		req.Error(ErrInternal, err.Error(), nil)
+		return
+	}
+	defer cur.Close()
+	var row interface{}
+	if err := cur.One(&row); err != nil && err != r.ErrEmptyResult {
+		req.Error(ErrInternal, "", nil)
+		return
+	}
+	if row == nil {
+		req.Result(ei.M{"counter": counter, "value": 0})
+		return
+	}
+	req.Result(counterResult(row))
+}
@@ -77,6 +77,34 @@ func dbBootstrap() error {
 		}
 
 	}
+	if !inStrSlice(tablelist, "pipemsgs") {
+		Log.Println("Creating pipemsgs table")
+		_, err := r.TableCreate("pipemsgs").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "retained") {
+		Log.Println("Creating retained table")
+		_, err := r.TableCreate("retained").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "streams") {
+		Log.Println("Creating streams table")
+		_, err := r.TableCreate("streams").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "streammsgs") {
+		Log.Println("Creating streammsgs table")
+		_, err := r.TableCreate("streammsgs").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
 	if !inStrSlice(tablelist, "users") {
 		Log.Println("Creating users table")
 		_, err := r.TableCreate("users").RunWrite(db)
@@ -84,8 +112,11 @@ func dbBootstrap() error {
 			return err
 		}
 		Log.Println("Creating root user")
-		ud := UserData{User: "root", Salt: safeId(16), Tags: map[string]map[string]interface{}{".": {"@admin": true}}, CreatedAt: time.Now()}
-		ud.Pass, err = HashPass("root", ud.Salt)
+		ud := UserData{User: "root", Tags: map[string]map[string]interface{}{".": {"@admin": true}}, CreatedAt: time.Now()}
+		ud.Pass, err = EncodePass("root")
+		if err != nil {
+			return err
+		}
 		_, err = r.Table("users").Insert(&ud).RunWrite(db)
 		if err != nil {
 			return err
@@ -145,6 +176,48 @@ func dbBootstrap() error {
 			return err
 		}
 	}
+	if !inStrSlice(tablelist, "barriers") {
+		Log.Println("Creating barriers table")
+		_, err := r.TableCreate("barriers").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "kv") {
+		Log.Println("Creating kv table")
+		_, err := r.TableCreate("kv").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "counters") {
+		Log.Println("Creating counters table")
+		_, err := r.TableCreate("counters").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "logins") {
+		Log.Println("Creating logins table")
+		_, err := r.TableCreate("logins").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "fences") {
+		Log.Println("Creating fences table")
+		_, err := r.TableCreate("fences").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(tablelist, "lockwaits") {
+		Log.Println("Creating lockwaits table")
+		_, err := r.TableCreate("lockwaits").RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
 	cur, err = r.Table("pipes").IndexList().Run(db)
 	pipesIndexlist := make([]string, 0)
 	err = cur.All(&pipesIndexlist)
@@ -161,6 +234,60 @@ func dbBootstrap() error {
 			return err
 		}
 	}
+	if !inStrSlice(pipesIndexlist, "watches") {
+		Log.Println("Creating watches index on pipes table")
+		_, err := r.Table("pipes").IndexCreateFunc("watches", func(row r.Term) interface{} {
+			return row.Field("watches")
+		}, r.IndexCreateOpts{Multi: true}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(pipesIndexlist, "wsubs") {
+		Log.Println("Creating wsubs index on pipes table")
+		_, err := r.Table("pipes").IndexCreateFunc("wsubs", func(row r.Term) interface{} {
+			return row.Field("wsubs").Values()
+		}, r.IndexCreateOpts{Multi: true}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(pipesIndexlist, "owner") {
+		Log.Println("Creating owner index on pipes table")
+		_, err := r.Table("pipes").IndexCreateFunc("owner", func(row r.Term) interface{} {
+			return row.Field("owner")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(pipesIndexlist, "holder") {
+		Log.Println("Creating holder index on pipes table")
+		_, err := r.Table("pipes").IndexCreateFunc("holder", func(row r.Term) interface{} {
+			return row.Field("holder")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(pipesIndexlist, "owners") {
+		Log.Println("Creating owners index on pipes table")
+		_, err := r.Table("pipes").IndexCreateFunc("owners", func(row r.Term) interface{} {
+			return row.Field("owners")
+		}, r.IndexCreateOpts{Multi: true}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(pipesIndexlist, "expires") {
+		Log.Println("Creating expires index on pipes table")
+		_, err := r.Table("pipes").IndexCreateFunc("expires", func(row r.Term) interface{} {
+			return row.Field("expires")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
 	cur, err = r.Table("tasks").IndexList().Run(db)
 	tasksIndexlist := make([]string, 0)
 	err = cur.All(&tasksIndexlist)
@@ -220,6 +347,129 @@ func dbBootstrap() error {
 			return err
 		}
 	}
+	if !inStrSlice(locksIndexlist, "owners") {
+		Log.Println("Creating owners index on locks table")
+		_, err := r.Table("locks").IndexCreateFunc("owners", func(row r.Term) interface{} {
+			return row.Field("owners")
+		}, r.IndexCreateOpts{Multi: true}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(locksIndexlist, "expires") {
+		Log.Println("Creating expires index on locks table")
+		_, err := r.Table("locks").IndexCreateFunc("expires", func(row r.Term) interface{} {
+			return row.Field("expires")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	cur, err = r.Table("streammsgs").IndexList().Run(db)
+	streammsgsIndexlist := make([]string, 0)
+	err = cur.All(&streammsgsIndexlist)
+	cur.Close()
+	if err != nil {
+		return err
+	}
+	if !inStrSlice(streammsgsIndexlist, "stime") {
+		Log.Println("Creating stime index on streammsgs table")
+		_, err := r.Table("streammsgs").IndexCreateFunc("stime", func(row r.Term) interface{} {
+			return ei.S{row.Field("id").Nth(0), row.Field("time")}
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	cur, err = r.Table("barriers").IndexList().Run(db)
+	barriersIndexlist := make([]string, 0)
+	err = cur.All(&barriersIndexlist)
+	cur.Close()
+	if err != nil {
+		return err
+	}
+	if !inStrSlice(barriersIndexlist, "owner") {
+		Log.Println("Creating owner index on barriers table")
+		_, err := r.Table("barriers").IndexCreateFunc("owner", func(row r.Term) interface{} {
+			return row.Field("owner")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	if !inStrSlice(barriersIndexlist, "arrived") {
+		Log.Println("Creating arrived index on barriers table")
+		_, err := r.Table("barriers").IndexCreateFunc("arrived", func(row r.Term) interface{} {
+			return row.Field("arrived")
+		}, r.IndexCreateOpts{Multi: true}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	cur, err = r.Table("kv").IndexList().Run(db)
+	kvIndexlist := make([]string, 0)
+	err = cur.All(&kvIndexlist)
+	cur.Close()
+	if err != nil {
+		return err
+	}
+	if !inStrSlice(kvIndexlist, "expires") {
+		Log.Println("Creating expires index on kv table")
+		_, err := r.Table("kv").IndexCreateFunc("expires", func(row r.Term) interface{} {
+			return row.Field("expires")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	cur, err = r.Table("counters").IndexList().Run(db)
+	countersIndexlist := make([]string, 0)
+	err = cur.All(&countersIndexlist)
+	cur.Close()
+	if err != nil {
+		return err
+	}
+	if !inStrSlice(countersIndexlist, "expires") {
+		Log.Println("Creating expires index on counters table")
+		_, err := r.Table("counters").IndexCreateFunc("expires", func(row r.Term) interface{} {
+			return row.Field("expires")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	cur, err = r.Table("logins").IndexList().Run(db)
+	loginsIndexlist := make([]string, 0)
+	err = cur.All(&loginsIndexlist)
+	cur.Close()
+	if err != nil {
+		return err
+	}
+	if !inStrSlice(loginsIndexlist, "expires") {
+		Log.Println("Creating expires index on logins table")
+		_, err := r.Table("logins").IndexCreateFunc("expires", func(row r.Term) interface{} {
+			return row.Field("expires")
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
+	cur, err = r.Table("lockwaits").IndexList().Run(db)
+	lockwaitsIndexlist := make([]string, 0)
+	err = cur.All(&lockwaitsIndexlist)
+	cur.Close()
+	if err != nil {
+		return err
+	}
+	if !inStrSlice(lockwaitsIndexlist, "locktime") {
+		Log.Println("Creating locktime index on lockwaits table")
+		_, err := r.Table("lockwaits").IndexCreateFunc("locktime", func(row r.Term) interface{} {
+			return ei.S{row.Field("lock"), row.Field("time")}
+		}).RunWrite(db)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -264,10 +514,43 @@ func dbClean(prefix string) (err error) {
 		})
 	}
 
-	// Delete all pipes from this prefix
+	// Resumable pipes outlive their owner session for a grace period, but not the node holding them
+	if len(prefix) > len(nodeId) {
+		_, err = r.Table("pipes").
+			Between(prefix, prefix+"\uffff", r.BetweenOpts{Index: "owner"}).
+			Filter(r.Row.Field("resumable").Default(false)).
+			Update(map[string]interface{}{"owner": r.Literal(), "expires": r.Now().Add(r.Row.Field("grace")), "ismsg": false, "msg": nil}).
+			RunWrite(db, r.RunOpts{Durability: "soft"})
+		if err != nil {
+			return
+		}
+		// Delete all pipes from this prefix
+		_, err = pipesDelete(r.Table("pipes").
+			Between(prefix, prefix+"\uffff").
+			Filter(r.Row.Field("resumable").Default(false).Not())).
+			RunWrite(db, r.RunOpts{Durability: "soft"})
+		if err != nil {
+			return
+		}
+	} else {
+		// Delete all pipes held by this node or attached from it
+		for _, index := range []string{"holder", "owner"} {
+			_, err = pipesDelete(r.Table("pipes").Between(prefix, prefix+"\uffff", r.BetweenOpts{Index: index})).
+				RunWrite(db, r.RunOpts{Durability: "soft"})
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// Leave all shared pipes opened from this prefix, they are only deleted by pipe.close
 	_, err = r.Table("pipes").
-		Between(prefix, prefix+"\uffff").
-		Delete().
+		Between(prefix, prefix+"\uffff", r.BetweenOpts{Index: "owners"}).
+		Update(func(p r.Term) interface{} {
+			return ei.M{"owners": p.Field("owners").Filter(func(o r.Term) interface{} {
+				return o.Lt(prefix).Or(o.Gt(prefix + "\uffff"))
+			})}
+		}).
 		RunWrite(db, r.RunOpts{Durability: "soft"})
 	if err != nil {
 		return
@@ -282,6 +565,55 @@ func dbClean(prefix string) (err error) {
 		return
 	}
 
+	// Leave all shared locks held from this prefix
+	_, err = r.Table("locks").
+		Between(prefix, prefix+"\uffff", r.BetweenOpts{Index: "owners"}).
+		Replace(func(l r.Term) interface{} {
+			owners := l.Field("owners").Filter(func(o r.Term) interface{} {
+				return o.Lt(prefix).Or(o.Gt(prefix + "\uffff"))
+			})
+			leases := l.Field("leases").Default(ei.M{})
+			return r.Branch(owners.IsEmpty(), nil,
+				lockLeases(l.Merge(ei.M{"owners": owners}), leases.Without(leases.Keys().SetDifference(owners))))
+		}).
+		RunWrite(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return
+	}
+
+	// Delete all latches from this prefix
+	_, err = r.Table("barriers").
+		Between(prefix, prefix+"\uffff", r.BetweenOpts{Index: "owner"}).
+		Delete().
+		RunWrite(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return
+	}
+
+	// Leave all barriers and latches reached from this prefix
+	_, err = r.Table("barriers").
+		Between(prefix, prefix+"\uffff", r.BetweenOpts{Index: "arrived"}).
+		Replace(func(b r.Term) interface{} {
+			arrived := b.Field("arrived").Filter(func(t r.Term) interface{} {
+				return t.Lt(prefix).Or(t.Gt(prefix + "\uffff"))
+			})
+			return r.Branch(arrived.IsEmpty().And(b.Field("kind").Eq(BarrierKind)), nil,
+				b.Merge(ei.M{"arrived": arrived}))
+		}).
+		RunWrite(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return
+	}
+
+	// Delete all lock waiters from this prefix
+	_, err = r.Table("lockwaits").
+		Between(prefix, prefix+"\uffff").
+		Delete().
+		RunWrite(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return
+	}
+
 	// Delete all sessions from this node
 	_, err = r.Table("sessions").
 		Between(prefix, prefix+"\uffff").
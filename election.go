@@ -0,0 +1,208 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jaracil/ei"
+	. "github.com/jaracil/nexus/log"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Elections are locks named after them. Their candidates queue up on the lockwaits
+// table and keep campaigning on their node until they resign or their session ends,
+// taking the lock in arrival order when the leader leaves.
+
+type Campaign struct {
+	Ticket string
+	Cancel context.CancelFunc
+}
+
+type Campaigns struct {
+	*sync.Mutex
+	Map map[string]*Campaign
+}
+
+var campaigns = &Campaigns{&sync.Mutex{}, map[string]*Campaign{}}
+
+// Register a campaign of the session, returning false if it's already a candidate
+func (c *Campaigns) Add(connId string, election string, cp *Campaign) bool {
+	c.Lock()
+	defer c.Unlock()
+	key := connId + "|" + election
+	if _, ok := c.Map[key]; ok {
+		return false
+	}
+	c.Map[key] = cp
+	return true
+}
+
+// Stop a campaign of the session, returning nil if it was not a candidate
+func (c *Campaigns) Cancel(connId string, election string) *Campaign {
+	c.Lock()
+	defer c.Unlock()
+	key := connId + "|" + election
+	cp, ok := c.Map[key]
+	if ok {
+		cp.Cancel()
+		delete(c.Map, key)
+	}
+	return cp
+}
+
+// Forget a finished campaign, unless the session is already running a new one
+func (c *Campaigns) Done(connId string, election string, ticket string) {
+	c.Lock()
+	defer c.Unlock()
+	key := connId + "|" + election
+	if cp, ok := c.Map[key]; ok && cp.Ticket == ticket {
+		cp.Cancel()
+		delete(c.Map, key)
+	}
+}
+
+// Return the leader of the election and the fencing token of its leadership
+func electionLeader(election string) (string, int64, error) {
+	cur, err := r.Table("locks").
+		Get(election).
+		Do(func(l r.Term) interface{} {
+			return ei.M{"leader": l.Field("owner").Default(""), "token": l.Field("token").Default(0)}
+		}).
+		Run(db)
+	if err != nil {
+		return "", 0, err
+	}
+	defer cur.Close()
+	res := ei.M{}
+	if err := cur.One(&res); err != nil {
+		return "", 0, err
+	}
+	return ei.N(res).M("leader").StringZ(), ei.N(res).M("token").Int64Z(), nil
+}
+
+// Campaigns wait for changes of their election, and recheck it after this time in case one was missed
+const _campaignRecheck = time.Second * 30
+
+// Run for the election, notifying the candidate on every change of its leader. The leader leaves the
+// queue while it holds the election, so it doesn't hold back the sessions waiting on the lock.
+func (nc *NexusConn) campaign(ctx context.Context, election string, ticket string, leader string) {
+	defer campaigns.Done(nc.connId, election, ticket)
+	defer r.Table("lockwaits").Get(ticket).Delete().RunWrite(db, r.RunOpts{Durability: "soft"})
+	row := ei.M{"id": election, "owner": nc.connId}
+	queued := true
+	for ctx.Err() == nil {
+		wake := lockWaiters.Wait(election)
+		if queued {
+			if _, err := lockAcquire(row, ticket); err != nil {
+				Log.WithFields(logrus.Fields{
+					"election": election,
+					"error":    err.Error(),
+				}).Errorf("Error campaigning")
+			}
+		}
+		current, token, err := electionLeader(election)
+		if err == nil {
+			if current != leader {
+				leader = current
+				nc.pushNotif("sync.leader", ei.M{"election": election, "leader": leader, "elected": leader == nc.connId, "token": token})
+			}
+			if current == nc.connId && queued {
+				_, err := r.Table("lockwaits").Get(ticket).Delete().RunWrite(db, r.RunOpts{Durability: "hard"})
+				queued = err != nil
+			} else if current != nc.connId && !queued {
+				// The leadership was lost, so the candidate queues up again
+				_, err := r.Table("lockwaits").
+					Insert(ei.M{"id": ticket, "lock": election, "time": r.Now()}).
+					RunWrite(db, r.RunOpts{Durability: "hard"})
+				if queued = err == nil; queued {
+					continue
+				}
+			}
+		}
+		select {
+		case <-wake:
+		case <-time.After(_campaignRecheck):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (nc *NexusConn) handleElectionReq(req *JsonRpcReq) {
+	election, err := ei.N(req.Params).M("election").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+	if err != nil {
+		req.Error(ErrInvalidParams, "election", nil)
+		return
+	}
+	tags := nc.getTags(election)
+	if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+		req.Error(ErrPermissionDenied, "", nil)
+		return
+	}
+	switch req.Method {
+	case "sync.elect":
+		ctx, cancel := context.WithCancel(nc.context)
+		ticket := nc.connId + safeId(10)
+		if !campaigns.Add(nc.connId, election, &Campaign{Ticket: ticket, Cancel: cancel}) {
+			cancel()
+			req.Error(ErrInvalidParams, "already a candidate", nil)
+			return
+		}
+		_, err := r.Table("lockwaits").
+			Insert(ei.M{"id": ticket, "lock": election, "time": r.Now()}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			campaigns.Cancel(nc.connId, election)
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		row := ei.M{"id": election, "owner": nc.connId}
+		if _, err := lockAcquire(row, ticket); err != nil {
+			r.Table("lockwaits").Get(ticket).Delete().RunWrite(db, r.RunOpts{Durability: "soft"})
+			campaigns.Cancel(nc.connId, election)
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		leader, token, err := electionLeader(election)
+		if err != nil {
+			r.Table("lockwaits").Get(ticket).Delete().RunWrite(db, r.RunOpts{Durability: "soft"})
+			campaigns.Cancel(nc.connId, election)
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		go nc.campaign(ctx, election, ticket, leader)
+		req.Result(ei.M{"ok": true, "leader": leader, "elected": leader == nc.connId, "token": token})
+
+	case "sync.resign":
+		cp := campaigns.Cancel(nc.connId, election)
+		if cp == nil {
+			req.Error(ErrLockNotOwned, "", nil)
+			return
+		}
+		// Leave the queue first, so the campaign can't take the leadership again
+		_, err := r.Table("lockwaits").Get(cp.Ticket).Delete().RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, err.Error(), nil)
+			return
+		}
+		_, err = r.Table("locks").
+			GetAll(election).
+			Filter(r.Row.Field("owner").Default("").Eq(nc.connId)).
+			Delete().
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, err.Error(), nil)
+			return
+		}
+		req.Result(ei.M{"ok": true})
+
+	case "sync.leader":
+		leader, token, err := electionLeader(election)
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		req.Result(ei.M{"leader": leader, "elected": leader == nc.connId, "token": token})
+	}
+}
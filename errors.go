@@ -8,6 +8,8 @@ const (
 	ErrMethodNotFound   = -32601
 	ErrTtlExpired       = -32011
 	ErrPermissionDenied = -32010
+	ErrLockedOut        = -32008
+	ErrVersionMismatch  = -32007
 	ErrLockNotOwned     = -32006
 	ErrUserExists       = -32005
 	ErrInvalidUser      = -32004
@@ -32,5 +34,7 @@ var ErrStr = map[int]string{
 	ErrUserExists:       "User already exists",
 	ErrPermissionDenied: "Permission denied",
 	ErrTtlExpired:       "TTL expired",
+	ErrVersionMismatch:  "Version mismatch",
+	ErrLockedOut:        "Locked out",
 	ErrLockNotOwned: 	 "Lock not owned",
 }
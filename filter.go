@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jaracil/ei"
+)
+
+// Topic subscription filters are small boolean expressions on the published message, like:
+//   msg.temp >= 30 && (msg.unit == "C" || !msg.converted)
+// Values are read with paths rooted at msg or topic, and compared with ==, !=, <, <=, > and >=.
+
+type filterNode interface {
+	eval(env map[string]interface{}) interface{}
+}
+
+type filterLiteral struct {
+	value interface{}
+}
+
+type filterPath struct {
+	keys []interface{}
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+type filterBinary struct {
+	op          string
+	left, right filterNode
+}
+
+type TopicFilter struct {
+	root filterNode
+}
+
+type TopicFilters struct {
+	*sync.Mutex
+	Map map[string]*TopicFilter
+}
+
+var topicFilters = &TopicFilters{&sync.Mutex{}, map[string]*TopicFilter{}}
+
+const _topicFiltersMaxCached = 1000
+
+// Limits on the filters, which are parsed recursively
+const (
+	_topicFilterMaxLen   = 1024
+	_topicFilterMaxDepth = 32
+)
+
+// Return the compiled filter, compiling it only once
+func (tf *TopicFilters) Get(expr string) (*TopicFilter, error) {
+	tf.Lock()
+	defer tf.Unlock()
+	if f, ok := tf.Map[expr]; ok {
+		return f, nil
+	}
+	f, err := compileTopicFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tf.Map) >= _topicFiltersMaxCached {
+		tf.Map = map[string]*TopicFilter{}
+	}
+	tf.Map[expr] = f
+	return f, nil
+}
+
+func compileTopicFilter(expr string) (*TopicFilter, error) {
+	if len(expr) > _topicFilterMaxLen {
+		return nil, fmt.Errorf("filter longer than %d bytes", _topicFilterMaxLen)
+	}
+	tokens, err := filterTokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return &TopicFilter{root}, nil
+}
+
+func (f *TopicFilter) Match(topic string, msg interface{}) bool {
+	return filterTruthy(f.root.eval(map[string]interface{}{"topic": topic, "msg": msg}))
+}
+
+func filterTokenize(expr string) ([]string, error) {
+	tokens := make([]string, 0)
+	rs := []rune(expr)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(rs) && rs[j] != c {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, string(rs[i:j+1]))
+			i = j + 1
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E') {
+				j++
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		default:
+			if i+1 < len(rs) {
+				if op := string(rs[i : i+2]); op == "&&" || op == "||" || op == "==" || op == "!=" || op == "<=" || op == ">=" {
+					tokens = append(tokens, op)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()[].!<>", c) {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+	depth  int
+}
+
+// Account for a nested expression, failing on too deep ones
+func (p *filterParser) nest() error {
+	p.depth++
+	if p.depth > _topicFilterMaxDepth {
+		return fmt.Errorf("filter nested deeper than %d levels", _topicFilterMaxDepth)
+	}
+	return nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right filterNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &filterBinary{"||", left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right filterNode
+		if right, err = p.parseUnary(); err == nil {
+			left = &filterBinary{"&&", left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.peek() == "!" {
+		p.next()
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseUnary()
+		p.depth--
+		return &filterNot{node}, err
+	}
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterBinary{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case t == "(":
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return node, nil
+	case t == "true" || t == "false":
+		return &filterLiteral{t == "true"}, nil
+	case t == "null":
+		return &filterLiteral{nil}, nil
+	case t[0] == '"' || t[0] == '\'':
+		s := t[1 : len(t)-1]
+		if t[0] == '"' {
+			var err error
+			if s, err = strconv.Unquote(t); err != nil {
+				return nil, fmt.Errorf("invalid string %s", t)
+			}
+		}
+		return &filterLiteral{s}, nil
+	case t == "msg" || t == "topic":
+		path := &filterPath{keys: []interface{}{t}}
+		for {
+			switch p.peek() {
+			case ".":
+				p.next()
+				key := p.next()
+				if key == "" || !(unicode.IsLetter(rune(key[0])) || key[0] == '_' || unicode.IsDigit(rune(key[0]))) {
+					return nil, fmt.Errorf("invalid path key %q", key)
+				}
+				path.keys = append(path.keys, key)
+			case "[":
+				p.next()
+				idx, err := strconv.Atoi(p.next())
+				if err != nil || p.next() != "]" {
+					return nil, fmt.Errorf("invalid path index")
+				}
+				path.keys = append(path.keys, idx)
+			default:
+				return path, nil
+			}
+		}
+	}
+	if n, err := strconv.ParseFloat(t, 64); err == nil {
+		return &filterLiteral{n}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
+
+func (n *filterLiteral) eval(env map[string]interface{}) interface{} {
+	return n.value
+}
+
+func (n *filterPath) eval(env map[string]interface{}) interface{} {
+	v := ei.N(env)
+	for _, key := range n.keys {
+		switch k := key.(type) {
+		case string:
+			v = v.M(k)
+		case int:
+			v = v.S(k)
+		}
+	}
+	return v.RawZ()
+}
+
+func (n *filterNot) eval(env map[string]interface{}) interface{} {
+	return !filterTruthy(n.node.eval(env))
+}
+
+func (n *filterBinary) eval(env map[string]interface{}) interface{} {
+	switch n.op {
+	case "&&":
+		return filterTruthy(n.left.eval(env)) && filterTruthy(n.right.eval(env))
+	case "||":
+		return filterTruthy(n.left.eval(env)) || filterTruthy(n.right.eval(env))
+	}
+	left, right := n.left.eval(env), n.right.eval(env)
+	if lf, err := ei.N(left).Float64(); err == nil && filterIsNumber(left) {
+		if rf, err := ei.N(right).Float64(); err == nil && filterIsNumber(right) {
+			return filterCompare(n.op, lf, rf)
+		}
+	}
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok && rok {
+		return filterCompare(n.op, strings.Compare(ls, rs), 0)
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	}
+	return false
+}
+
+func filterCompare(op string, l interface{}, r interface{}) bool {
+	var lf, rf float64
+	switch lv := l.(type) {
+	case float64:
+		lf, rf = lv, r.(float64)
+	case int:
+		lf, rf = float64(lv), float64(r.(int))
+	}
+	switch op {
+	case "==":
+		return lf == rf
+	case "!=":
+		return lf != rf
+	case "<":
+		return lf < rf
+	case "<=":
+		return lf <= rf
+	case ">":
+		return lf > rf
+	case ">=":
+		return lf >= rf
+	}
+	return false
+}
+
+func filterIsNumber(v interface{}) bool {
+	switch v.(type) {
+	case float64, float32, int, int64, int32, uint, uint64, uint32:
+		return true
+	}
+	_, ok := v.(interface {
+		Float64() (float64, error)
+	})
+	return ok
+}
+
+func filterTruthy(v interface{}) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	case string:
+		return b != ""
+	}
+	if filterIsNumber(v) {
+		return ei.N(v).Float64Z() != 0
+	}
+	return true
+}
@@ -78,10 +78,9 @@ func hookList(ty string, path string, user string) (res []interface{}) {
 func hookPublish(ty string, path string, user string, message interface{}) (int, error) {
 	msg := ei.M{"topic": fmt.Sprintf("hook.%s|%s|%s", ty, path, user), "msg": message}
 	hookTopics := hookList(ty, path, user)
-	res, err := r.Table("pipes").
-		GetAllByIndex("subs", hookTopics...).
-		Update(map[string]interface{}{"msg": r.Literal(msg), "count": r.Row.Field("count").Add(1), "ismsg": true}).
-		RunWrite(db, r.RunOpts{Durability: "soft"})
+	res, err := pipesWrite(r.Table("pipes").GetAllByIndex("subs", hookTopics...), msg, func(p r.Term) interface{} {
+		return pipeMsgUpdate(p, msg)
+	}).RunWrite(db, r.RunOpts{Durability: "soft"})
 	return res.Replaced, err
 }
 
@@ -33,14 +33,16 @@ func (*httpwsHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 			wsrv := &websocket.Server{}
 			wsrv.Handler = func(ws *websocket.Conn) {
-				nc := NewNexusConn(ws)
+				proto := "ws"
 				if req.TLS != nil {
-					nc.proto = "wss"
-				} else {
-					nc.proto = "ws"
+					proto = "wss"
 				}
 
-				ws.Config().Origin = &url.URL{Scheme: nc.proto, Host: req.RemoteAddr}
+				// The remote address of ws is its origin, which must be set before creating the connection
+				ws.Config().Origin = &url.URL{Scheme: proto, Host: req.RemoteAddr}
+				nc := NewNexusConn(ws)
+				nc.proto = proto
+				nc.remote = req.RemoteAddr
 
 				Log.WithFields(logrus.Fields{
 					"remote": ws.RemoteAddr().String(),
@@ -82,6 +84,7 @@ func (*httpwsHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		netCli, netSrv := net.Pipe()
 		netCliBuf := bufio.NewReaderSize(netCli, opts.MaxMessageSize)
 		ns := NewNexusConn(netSrv)
+		ns.remote = req.RemoteAddr
 		if req.TLS != nil {
 			ns.proto = "https"
 		} else {
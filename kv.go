@@ -0,0 +1,212 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jaracil/ei"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Keys of the kv table hold a value and a version, increased on every write.
+// Deleted keys are kept as tombstones holding their last version, so the versions of a key keep
+// increasing across its deletions and a version from a former value never matches a new one.
+// Keys with a ttl are gone when they expire, even before kvPurge turns them into tombstones.
+
+// Turn the expired keys into tombstones
+func kvPurge() {
+	defer exit("kv purge goroutine error")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if isMasterNode() {
+				r.Table("kv").
+					Between(r.MinVal, r.Now(), r.BetweenOpts{Index: "expires"}).
+					Replace(func(k r.Term) interface{} {
+						return r.Branch(k.Field("expires").Le(r.Now()), kvTombstone(k), k)
+					}).
+					RunWrite(db, r.RunOpts{Durability: "soft"})
+			}
+		case <-mainContext.Done():
+			return
+		}
+	}
+}
+
+// Whether the key row holds a value which has not expired
+func kvLive(k r.Term) r.Term {
+	return k.Field("deleted").Default(false).Not().And(k.Field("expires").Default(r.MaxVal).Gt(r.Now()))
+}
+
+// Version of the key row, 0 when it does not exist, it was deleted or it has expired
+func kvVersion(k r.Term) r.Term {
+	return r.Branch(k.Eq(nil), 0,
+		kvLive(k).Not(), 0,
+		k.Field("version"))
+}
+
+// Row left by a deleted key
+func kvTombstone(k r.Term) ei.M {
+	return ei.M{"id": k.Field("id"), "version": k.Field("version"), "deleted": true}
+}
+
+// Row of a key written over k, whose version follows the last one of the key even if it was deleted
+func kvRow(key string, value interface{}, k r.Term, ttl float64) ei.M {
+	row := ei.M{"id": key, "value": value, "version": k.Field("version").Default(0).Add(1)}
+	if ttl > 0 {
+		row["ttl"] = ttl
+		row["expires"] = r.Now().Add(ttl)
+	}
+	return row
+}
+
+func kvResult(row interface{}) ei.M {
+	k := ei.N(row)
+	res := ei.M{"key": k.M("id").StringZ(), "value": k.M("value").RawZ(), "version": k.M("version").Int64Z()}
+	if expires := k.M("expires").RawZ(); expires != nil {
+		res["expires"] = expires
+	}
+	return res
+}
+
+func (nc *NexusConn) handleKvReq(req *JsonRpcReq) {
+	switch req.Method {
+	case "kv.get", "kv.set", "kv.cas", "kv.delete":
+		key, err := ei.N(req.Params).M("key").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "key", nil)
+			return
+		}
+		tags := nc.getTags(key)
+		if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		value := ei.N(req.Params).M("value").RawZ()
+		ttl := ei.N(req.Params).M("ttl").Float64Z()
+
+		switch req.Method {
+		case "kv.get":
+			live := r.Table("kv").Get(key)
+			cur, err := r.Branch(kvVersion(live).Eq(0), nil, live).Run(db)
+			if err != nil {
+				req.Error(ErrInternal, err.Error(), nil)
+				return
+			}
+			defer cur.Close()
+			var row interface{}
+			if err := cur.One(&row); err != nil && err != r.ErrEmptyResult {
+				req.Error(ErrInternal, "", nil)
+				return
+			}
+			if row == nil {
+				req.Result(ei.M{"key": key, "value": nil, "version": 0})
+				return
+			}
+			req.Result(kvResult(row))
+
+		case "kv.set":
+			res, err := r.Table("kv").
+				Get(key).
+				Replace(func(k r.Term) interface{} {
+					return kvRow(key, value, k, ttl)
+				}, r.ReplaceOpts{ReturnChanges: true}).
+				RunWrite(db, r.RunOpts{Durability: "hard"})
+			if err != nil {
+				req.Error(ErrInternal, err.Error(), nil)
+				return
+			}
+			if len(res.Changes) <= 0 {
+				req.Error(ErrInternal, "", nil)
+				return
+			}
+			req.Result(kvResult(res.Changes[0].NewValue))
+
+		case "kv.cas":
+			version, err := ei.N(req.Params).M("version").Int64()
+			if err != nil || version < 0 {
+				req.Error(ErrInvalidParams, "version", nil)
+				return
+			}
+			res, err := r.Table("kv").
+				Get(key).
+				Replace(func(k r.Term) interface{} {
+					return r.Branch(kvVersion(k).Eq(version), kvRow(key, value, k, ttl), k)
+				}, r.ReplaceOpts{ReturnChanges: "always"}).
+				RunWrite(db, r.RunOpts{Durability: "hard"})
+			if err != nil {
+				req.Error(ErrInternal, err.Error(), nil)
+				return
+			}
+			if res.Inserted+res.Replaced <= 0 {
+				current := int64(0)
+				if len(res.Changes) > 0 && res.Changes[0].NewValue != nil {
+					k := ei.N(res.Changes[0].NewValue)
+					expires, ok := k.M("expires").RawZ().(time.Time)
+					if !k.M("deleted").BoolZ() && (!ok || expires.After(time.Now())) {
+						current = k.M("version").Int64Z()
+					}
+				}
+				req.Error(ErrVersionMismatch, "", ei.M{"version": current})
+				return
+			}
+			req.Result(kvResult(res.Changes[0].NewValue))
+
+		case "kv.delete":
+			res, err := r.Table("kv").
+				Get(key).
+				Replace(func(k r.Term) interface{} {
+					return r.Branch(kvVersion(k).Eq(0), k, kvTombstone(k))
+				}).
+				RunWrite(db, r.RunOpts{Durability: "hard"})
+			if err != nil {
+				req.Error(ErrInternal, err.Error(), nil)
+				return
+			}
+			req.Result(ei.M{"ok": true, "deleted": res.Replaced > 0})
+		}
+
+	case "kv.list":
+		prefix, depth, filter, limit, skip := getListParams(req.Params)
+
+		tags := nc.getTags(prefix)
+		if !(ei.N(tags).M("@kv.list").BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+
+		// Deleted and expired keys are left out before paging
+		term := getListTerm("kv", "", "id", prefix, depth, filter, 0, -1).
+			Filter(kvLive)
+		if skip >= 0 {
+			term = term.Skip(skip)
+		}
+		if limit > 0 {
+			term = term.Limit(limit)
+		}
+		term = term.
+			Map(func(k r.Term) interface{} {
+				return k.Pluck("value", "version", "expires").Merge(ei.M{"key": k.Field("id")})
+			})
+
+		cur, err := term.Run(db)
+		defer cur.Close()
+		if err != nil {
+			req.Error(ErrInternal, err.Error(), nil)
+			return
+		}
+		var all []interface{}
+		if err := cur.All(&all); err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		req.Result(all)
+
+	case "kv.watch", "kv.unwatch":
+		nc.handleWatchReq(req, WatchKv, "kv.list", req.Method == "kv.watch")
+
+	default:
+		req.Error(ErrMethodNotFound, "", nil)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jaracil/ei"
+	. "github.com/jaracil/nexus/log"
+	"github.com/sirupsen/logrus"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Sessions waiting on a lock queue up on the lockwaits table, ordered by arrival time.
+// Only the head of the queue may grab a released lock, so they are granted in order.
+
+type LockWaiters struct {
+	*sync.Mutex
+	Map map[string]chan struct{}
+}
+
+var lockWaiters = &LockWaiters{&sync.Mutex{}, map[string]chan struct{}{}}
+
+// Return a channel which is closed on the next release of the lock
+func (w *LockWaiters) Wait(lock string) <-chan struct{} {
+	w.Lock()
+	defer w.Unlock()
+	ch, ok := w.Map[lock]
+	if !ok {
+		ch = make(chan struct{})
+		w.Map[lock] = ch
+	}
+	return ch
+}
+
+func (w *LockWaiters) Wake(lock string) {
+	w.Lock()
+	defer w.Unlock()
+	if ch, ok := w.Map[lock]; ok {
+		close(ch)
+		delete(w.Map, lock)
+	}
+}
+
+// Wake up the local waiters and candidates of a lock when it changes or the queue moves
+func lockTrack() {
+	defer exit("lock change-feed error")
+	for retry := 0; retry < 10; retry++ {
+		iter, err := r.Table("locks").
+			Changes(r.ChangesOpts{Squash: false}).
+			Map(func(c r.Term) interface{} {
+				return r.Branch(c.Field("old_val").Eq(nil), c.Field("new_val").Field("id"), c.Field("old_val").Field("id"))
+			}).
+			Union(r.Table("lockwaits").
+				Changes(r.ChangesOpts{Squash: false}).
+				Filter(r.Row.Field("new_val").Eq(nil)).
+				Map(func(c r.Term) interface{} {
+					return c.Field("old_val").Field("lock")
+				})).
+			Run(db)
+		if err != nil {
+			Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Errorf("Error opening lockTrack iterator")
+			time.Sleep(time.Second)
+			continue
+		}
+		retry = 0
+		for {
+			var lock string
+			if !iter.Next(&lock) {
+				Log.WithFields(logrus.Fields{
+					"error": iter.Err().Error(),
+				}).Errorf("Error processing lockTrack feed")
+				iter.Close()
+				break
+			}
+			lockWaiters.Wake(lock)
+		}
+	}
+}
+
+// Insert the lock row if the queue is empty, or ticket is at its head. Shared locks and semaphores
+// are joined by adding the session to their owners while the mode and capacity allow it. Semaphores
+// are only joined with the capacity they are held with.
+// Each grant bumps the fencing token kept on the lock row, which is returned, or 0 if the lock was not
+// granted. Fences outlive their locks, so the tokens given to the successive holders always increase.
+func lockAcquire(row ei.M, ticket string) (int64, error) {
+	lock := row["id"]
+	// The fence is read before the grant so the lock row is written atomically, and lockFence checks it after
+	write := func(fence r.Term) r.Term {
+		grant := func(l r.Term, granted r.Term) r.Term {
+			return granted.Merge(ei.M{"token": r.Expr(ei.S{l.Field("token").Default(0), fence}).Max().Add(1)})
+		}
+		switch ei.N(row).M("mode").StringZ() {
+		case LockShared:
+			return r.Table("locks").Get(lock).Replace(func(l r.Term) interface{} {
+				return r.Branch(l.Eq(nil), grant(l, r.Expr(row)),
+					l.Field("mode").Default("").Eq(LockShared), grant(l, lockJoin(l, row)),
+					l)
+			}, r.ReplaceOpts{ReturnChanges: true})
+		case LockSemaphore:
+			return r.Table("locks").Get(lock).Replace(func(l r.Term) interface{} {
+				owners := l.Field("owners").Default(ei.S{})
+				return r.Branch(l.Eq(nil), grant(l, r.Expr(row)),
+					l.Field("mode").Default("").Eq(LockSemaphore).And(l.Field("capacity").Eq(row["capacity"])).And(owners.Count().Lt(l.Field("capacity"))),
+					grant(l, lockJoin(l, row)),
+					l)
+			}, r.ReplaceOpts{ReturnChanges: true})
+		default:
+			return r.Table("locks").Get(lock).Replace(func(l r.Term) interface{} {
+				return r.Branch(l.Eq(nil), grant(l, r.Expr(row)), l)
+			}, r.ReplaceOpts{ReturnChanges: true})
+		}
+	}
+	queue := r.Table("lockwaits").
+		Between(ei.S{lock, r.MinVal}, ei.S{lock, r.MaxVal}, r.BetweenOpts{Index: "locktime"}).
+		OrderBy(r.OrderByOpts{Index: "locktime"}).
+		Limit(1).
+		CoerceTo("array")
+	turn := queue.IsEmpty()
+	if ticket != "" {
+		turn = r.Branch(turn, false, queue.Nth(0).Field("id").Eq(ticket))
+	}
+	res, err := r.Table("fences").
+		Get(lock).
+		Field("token").
+		Default(0).
+		Do(func(fence r.Term) interface{} {
+			return r.Branch(turn, write(fence), ei.M{"inserted": 0})
+		}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	if err != nil || res.Inserted+res.Replaced <= 0 || len(res.Changes) <= 0 {
+		return 0, err
+	}
+	return lockFence(ei.N(row).M("id").StringZ(), ei.N(res.Changes[0].NewValue).M("token").Int64Z())
+}
+
+// Raise the fence of a lock to the token of a grant, returning it. When the fence is already there, the
+// token may have been given before the fence read by the grant was raised, so the lock takes the next one.
+func lockFence(lock string, token int64) (int64, error) {
+	for {
+		res, err := r.Table("fences").
+			Get(lock).
+			Replace(func(f r.Term) interface{} {
+				return r.Branch(f.Eq(nil), ei.M{"id": lock, "token": token},
+					f.Field("token").Lt(token), f.Merge(ei.M{"token": token}),
+					f)
+			}, r.ReplaceOpts{ReturnChanges: "always"}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			return 0, err
+		}
+		if res.Inserted+res.Replaced > 0 || len(res.Changes) <= 0 {
+			return token, nil
+		}
+		token = ei.N(res.Changes[0].OldValue).M("token").Int64Z() + 1
+		_, err = r.Table("locks").
+			Get(lock).
+			Replace(func(l r.Term) interface{} {
+				return r.Branch(l.Eq(nil), l, l.Merge(ei.M{"token": r.Expr(ei.S{l.Field("token").Default(0), token}).Max()}))
+			}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Add the owner of row, and its lease if any, to a shared lock or semaphore
+func lockJoin(l r.Term, row ei.M) r.Term {
+	leases := l.Field("leases").Default(ei.M{}).Without(row["owners"])
+	if lease, ok := row["leases"]; ok {
+		leases = leases.Merge(lease)
+	}
+	return lockLeases(l.Merge(ei.M{"owners": l.Field("owners").Default(ei.S{}).SetUnion(row["owners"])}), leases)
+}
+
+// Queue up for the lock until it's granted, the wait times out or the session ends.
+// Returns the fencing token of the grant, or 0 if it was not granted.
+func (nc *NexusConn) lockWait(row ei.M, wait float64) (int64, error) {
+	lock := ei.N(row).M("id").StringZ()
+	ticket := nc.connId + safeId(10)
+	_, err := r.Table("lockwaits").
+		Insert(ei.M{"id": ticket, "lock": lock, "time": r.Now()}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	if err != nil {
+		return 0, err
+	}
+	defer r.Table("lockwaits").Get(ticket).Delete().RunWrite(db, r.RunOpts{Durability: "soft"})
+
+	toutCh := time.After(time.Duration(wait * float64(time.Second)))
+	for {
+		wake := lockWaiters.Wait(lock)
+		token, err := lockAcquire(row, ticket)
+		if token > 0 || err != nil {
+			return token, err
+		}
+		select {
+		case <-wake:
+		case <-time.After(time.Second):
+		case <-toutCh:
+			return 0, nil
+		case <-nc.context.Done():
+			return 0, nil
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/jaracil/ei"
+	. "github.com/jaracil/nexus/log"
+	"github.com/sirupsen/logrus"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Failed basic logins are counted on the logins table per user ("user|<user>") and per remote
+// address ("addr|<host>"). The answer of every failure is delayed twice as much as the previous
+// one, and reaching the threshold locks the user or the address out. Failures are forgotten
+// when no other one happens during the window.
+// Attempts are counted as failures before verifying them and taken back when they succeed, so
+// parallel attempts can't go past the threshold.
+
+const (
+	LoginUser = "user"
+	LoginAddr = "addr"
+)
+
+func loginKey(scope string, name string) string {
+	return scope + "|" + name
+}
+
+// Delete the failures whose window and lockout are over
+func loginPurge() {
+	defer exit("login purge goroutine error")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if isMasterNode() {
+				r.Table("logins").
+					Between(r.MinVal, r.Now(), r.BetweenOpts{Index: "expires"}).
+					Delete().
+					RunWrite(db, r.RunOpts{Durability: "soft"})
+			}
+		case <-mainContext.Done():
+			return
+		}
+	}
+}
+
+// Return the host of an address, without its port
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// A login attempt being verified, already counted as a failure on the keys of its user and address
+type LoginAttempt struct {
+	User     string
+	Host     string
+	Failures int                  // Most failures counted on a key, including this attempt
+	Lockouts map[string]time.Time // Lockouts started by this attempt, by scope
+}
+
+type loginCounter struct {
+	scope string
+	name  string
+	max   int
+}
+
+func (a *LoginAttempt) counters() []loginCounter {
+	return []loginCounter{{LoginUser, a.User, opts.Login.MaxUserFailures}, {LoginAddr, a.Host, opts.Login.MaxAddrFailures}}
+}
+
+// Count a login attempt on the key as a failure before verifying it, locking the key out when it reaches
+// max failures (0 never does). Attempts on a locked out key are not counted, and the count is checked and
+// increased by the same write, so parallel attempts can't go past max.
+// Returns whether the key was locked out, the failures counted and when the lockout ends if this attempt has started it.
+func loginCount(key string, max int) (bool, int, *time.Time, error) {
+	window := float64(opts.Login.Window)
+	lockout := float64(opts.Login.Lockout)
+	res, err := r.Table("logins").
+		Get(key).
+		Replace(func(l r.Term) interface{} {
+			failures := r.Branch(l.Eq(nil).Or(l.Field("expires").Le(r.Now())), 1, l.Field("failures").Add(1))
+			row := r.Expr(ei.M{"id": key, "failures": failures, "expires": r.Now().Add(window)})
+			if max > 0 {
+				row = r.Branch(failures.Ge(max),
+					row.Merge(ei.M{"locked": r.Now().Add(lockout), "expires": r.Now().Add(math.Max(window, lockout))}),
+					row)
+			}
+			return r.Branch(l.Ne(nil).And(l.Field("locked").Default(r.MinVal).Gt(r.Now())), l, row)
+		}, r.ReplaceOpts{ReturnChanges: true}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if len(res.Changes) <= 0 {
+		return true, 0, nil, nil
+	}
+	failures := ei.N(res.Changes[0].NewValue).M("failures").IntZ()
+	locked, ok := ei.N(res.Changes[0].NewValue).M("locked").RawZ().(time.Time)
+	if !ok {
+		return false, failures, nil, nil
+	}
+	return false, failures, &locked, nil
+}
+
+// Take back an attempt counted on the key, lifting the lockout it may have started
+func loginUncount(key string, max int) error {
+	_, err := r.Table("logins").
+		Get(key).
+		Replace(func(l r.Term) interface{} {
+			failures := l.Field("failures").Sub(1)
+			row := l.Merge(ei.M{"failures": failures})
+			if max > 0 {
+				row = r.Branch(failures.Lt(max), row.Without("locked"), row)
+			}
+			return r.Branch(l.Eq(nil).Or(failures.Le(0)), nil, row)
+		}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	return err
+}
+
+// Count a login attempt of user from the remote host before verifying it.
+// Returns a nil attempt if the user or the host is locked out.
+func loginReserve(user string, host string) (*LoginAttempt, error) {
+	a := &LoginAttempt{User: user, Host: host, Lockouts: map[string]time.Time{}}
+	counted := make([]loginCounter, 0)
+	for _, c := range a.counters() {
+		locked, n, lockout, err := loginCount(loginKey(c.scope, c.name), c.max)
+		if err != nil || locked {
+			for _, c := range counted {
+				loginUncount(loginKey(c.scope, c.name), c.max)
+			}
+			return nil, err
+		}
+		counted = append(counted, c)
+		if n > a.Failures {
+			a.Failures = n
+		}
+		if lockout != nil {
+			a.Lockouts[c.scope] = *lockout
+		}
+	}
+	return a, nil
+}
+
+// Keep the attempt counted as a failed login, and wait its delay
+func (nc *NexusConn) loginFailed(a *LoginAttempt) {
+	for scope, locked := range a.Lockouts {
+		Log.WithFields(logrus.Fields{
+			"connid":   nc.connId,
+			"user":     a.User,
+			"remote":   a.Host,
+			"scope":    scope,
+			"failures": a.Failures,
+			"until":    locked,
+		}).Warnf("Locked out after too many failed logins")
+		hook("user", a.User, a.User, ei.M{
+			"action":   "lockout",
+			"user":     a.User,
+			"remote":   a.Host,
+			"scope":    scope,
+			"failures": a.Failures,
+			"until":    locked,
+		})
+	}
+	time.Sleep(loginDelay(a.Failures))
+}
+
+// Take back an attempt which could not be verified
+func (nc *NexusConn) loginAborted(a *LoginAttempt) {
+	for _, c := range a.counters() {
+		if err := loginUncount(loginKey(c.scope, c.name), c.max); err != nil {
+			Log.WithFields(logrus.Fields{
+				"connid": nc.connId,
+				"error":  err.Error(),
+			}).Errorf("Error uncounting login attempt")
+		}
+	}
+}
+
+// Delay to answer a failed login
+func loginDelay(failures int) time.Duration {
+	if failures <= 0 || opts.Login.Delay <= 0 {
+		return 0
+	}
+	delay := float64(opts.Login.Delay) * math.Pow(2, float64(failures-1))
+	return time.Millisecond * time.Duration(math.Min(delay, float64(opts.Login.MaxDelay)))
+}
+
+// Forget the failed logins of the user after a successful attempt, which is taken back from its address
+func (nc *NexusConn) loginSucceeded(a *LoginAttempt) {
+	r.Table("logins").
+		Get(loginKey(LoginUser, a.User)).
+		Delete().
+		RunWrite(db, r.RunOpts{Durability: "soft"})
+	if err := loginUncount(loginKey(LoginAddr, a.Host), opts.Login.MaxAddrFailures); err != nil {
+		Log.WithFields(logrus.Fields{
+			"connid": nc.connId,
+			"error":  err.Error(),
+		}).Errorf("Error uncounting login attempt")
+	}
+}
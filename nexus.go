@@ -107,6 +107,27 @@ func main() {
 		Logger.Hooks.Add(logfileFormatter)
 	}
 
+	if err := checkPassHashOptions(); err != nil {
+		Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatalln("Error checking password hashing options")
+	}
+	if err := loadTaskCachePolicies(); err != nil {
+		Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatalln("Error loading task cache policies")
+	}
+	if err := loadTopicStreams(); err != nil {
+		Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatalln("Error loading topic streams")
+	}
+	if err := loadHiddenPublishers(); err != nil {
+		Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatalln("Error loading hidden publishers")
+	}
+
 	signal.Notify(sigChan)
 	go signalManager()
 
@@ -122,6 +143,15 @@ func main() {
 	go nodeTrack()
 	go taskTrack()
 	go pipeTrack()
+	go pipePurge()
+	go streamPurge()
+	go lockPurge()
+	go lockTrack()
+	go barrierTrack()
+	go kvPurge()
+	go counterPurge()
+	go loginPurge()
+	go watchTrack()
 	go sessionTrack()
 	go taskPurge()
 	go hooksTrack()
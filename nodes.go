@@ -213,8 +213,14 @@ func searchOrphaned(ctx context.Context) {
 
 			searchOrphanedStuff(nodesregexp, "sessions", "nodeId")
 			searchOrphanedStuff(nodesregexp, "tasks", "id")
-			searchOrphanedStuff(nodesregexp, "pipes", "id")
+			searchOrphanedStuff(nodesregexp, "pipes", "holder")
+			searchOrphanedStuff(nodesregexp, "pipes", "owner")
+			searchOrphanedOwners(nodesregexp, "pipes", "owners")
 			searchOrphanedStuff(nodesregexp, "locks", "owner")
+			searchOrphanedStuff(nodesregexp, "lockwaits", "id")
+			searchOrphanedOwners(nodesregexp, "locks", "owners")
+			searchOrphanedStuff(nodesregexp, "barriers", "owner")
+			searchOrphanedOwners(nodesregexp, "barriers", "arrived")
 		}
 	}
 }
@@ -272,6 +278,58 @@ func searchOrphanedStuff(regex, what, field string) {
 	}
 }
 
+// Like searchOrphanedStuff, for the rows holding their owners on an array field
+func searchOrphanedOwners(regex, what, field string) {
+	cur, err := r.Table(what).
+		Filter(r.Row.HasFields(field)).
+		ConcatMap(func(row r.Term) interface{} {
+			return row.Field(field)
+		}).
+		Filter(func(owner r.Term) r.Term {
+			return owner.Match(regex).Not()
+		}).
+		Distinct().
+		Run(db)
+	defer cur.Close()
+	if err != nil {
+		Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorf("Error searching orphaned %s %s", what, field)
+		return
+	}
+
+	orphans := make([]string, 0)
+	if err := cur.All(&orphans); err != nil && err != r.ErrEmptyResult {
+		Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorf("Error searching orphaned %s %s", what, field)
+		return
+	}
+	if len(orphans) <= 0 {
+		return
+	}
+
+	o := make([]string, 0)
+	for _, owner := range orphans {
+		if len(owner) >= 8 && !inStrSlice(o, owner[:8]) {
+			o = append(o, owner[:8])
+		}
+	}
+
+	Log.WithFields(logrus.Fields{
+		"orphans": o,
+	}).Warnf("Found %d orphaned %s %s", len(o), what, field)
+
+	for _, s := range o {
+		if err := dbClean(s); err != nil {
+			Log.WithFields(logrus.Fields{
+				"error": err,
+				what:    s,
+			}).Errorf("Error deleting orphaned %s %s", what, field)
+		}
+	}
+}
+
 func searchUncompleted(ctx context.Context) {
 	t := time.After(time.Second)
 	for {
@@ -7,8 +7,11 @@ import (
 )
 
 type nPoint struct {
-	ch    chan interface{}
-	drops int64
+	sync.Mutex
+	ch      chan interface{}
+	drops   int64
+	dropOld bool
+	queued  []interface{} // Items sent to ch, the last len(ch) ones are still queued
 }
 
 var ERROR_KEY_EXISTS = errors.New("Key already exists")
@@ -45,21 +48,55 @@ func (nt *Notifier) Unregister(key string) error {
 	return nil
 }
 
+// Make a full channel discard its oldest item instead of the newest one
+func (nt *Notifier) SetDropOld(key string, dropOld bool) error {
+	nt.Lock()
+	defer nt.Unlock()
+	np, ok := nt.m[key]
+	if !ok {
+		return ERROR_KEY_NOT_EXISTS
+	}
+	np.dropOld = dropOld
+	return nil
+}
+
 func (nt *Notifier) Notify(key string, d interface{}) error {
 	nt.RLock()
 	defer nt.RUnlock()
 	np, ok := nt.m[key]
 	if ok {
-		select {
-		case np.ch <- d:
-		default:
-			atomic.AddInt64(&np.drops, 1)
-			return ERROR_OVERFLOW
+		np.Lock()
+		defer np.Unlock()
+		for {
+			select {
+			case np.ch <- d:
+				np.queued = append(np.queued[len(np.queued)-np.pending():], d)
+				return nil
+			default:
+			}
+			if !np.dropOld {
+				atomic.AddInt64(&np.drops, 1)
+				return ERROR_OVERFLOW
+			}
+			select {
+			case <-np.ch:
+				atomic.AddInt64(&np.drops, 1)
+			default:
+			}
 		}
 	}
 	return ERROR_KEY_NOT_EXISTS
 }
 
+// Number of queued items, bounded by the ones recorded as sent. Must be called with np locked.
+func (np *nPoint) pending() int {
+	n := len(np.ch)
+	if n > len(np.queued) {
+		n = len(np.queued)
+	}
+	return n
+}
+
 func (nt *Notifier) Channel(key string) (chan interface{}, error) {
 	nt.RLock()
 	defer nt.RUnlock()
@@ -86,6 +123,18 @@ func (nt *Notifier) Drops(key string, reset bool) (int, error) {
 	return 0, ERROR_KEY_NOT_EXISTS
 }
 
+// Count n items dropped elsewhere
+func (nt *Notifier) AddDrops(key string, n int) error {
+	nt.RLock()
+	defer nt.RUnlock()
+	np, ok := nt.m[key]
+	if !ok {
+		return ERROR_KEY_NOT_EXISTS
+	}
+	atomic.AddInt64(&np.drops, int64(n))
+	return nil
+}
+
 func (nt *Notifier) Waiting(key string) (int, error) {
 	nt.RLock()
 	defer nt.RUnlock()
@@ -96,6 +145,26 @@ func (nt *Notifier) Waiting(key string) (int, error) {
 	return 0, ERROR_KEY_NOT_EXISTS
 }
 
+// Return up to max queued items without consuming them
+func (nt *Notifier) Peek(key string, max int) ([]interface{}, error) {
+	nt.RLock()
+	defer nt.RUnlock()
+	np, ok := nt.m[key]
+	if !ok {
+		return nil, ERROR_KEY_NOT_EXISTS
+	}
+	np.Lock()
+	defer np.Unlock()
+	// Readers consume the oldest items, so the queued ones are the newest sent
+	queued := np.queued[len(np.queued)-np.pending():]
+	if len(queued) > max {
+		queued = queued[:max]
+	}
+	items := make([]interface{}, len(queued))
+	copy(items, queued)
+	return items, nil
+}
+
 func (nt *Notifier) Purge(key string, n int) (int, error) {
 	nt.RLock()
 	defer nt.RUnlock()
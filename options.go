@@ -12,9 +12,14 @@ var opts struct {
 	IsProduction   bool           `long:"production" description:"Enables Production mode (JSON output and redacted logs for login requests)"`
 	MaxMessageSize int            `long:"maxmsgsize" description:"Maximum size in bytes for a jsonrpc message that can be accepted (buffer size)" default:"33554432"`
 	Version        bool           `long:"version" description:"Show Nexus version"`
+	TaskCache      []string       `long:"taskcache" description:"Cache the results of the tasks pushed to a path (path:ttl[:maxentries]). Can be set multiple times"`
+	TopicStream    []string       `long:"topicstream" description:"Keep the messages published below a topic prefix as a durable stream (prefix[:retention]). Can be set multiple times"`
+	HidePublisher  []string       `long:"hidepublisher" description:"Hide the user and connid of the publishers of topics below a prefix. Can be set multiple times"`
 	Logs           LogsOptions    `group:"Logging Options"`
 	Rethink        RethinkOptions `group:"RethinkDB Options"`
 	SSL            SSLOptions     `group:"SSL Options"`
+	PassHash       PassOptions    `group:"Password Hashing Options"`
+	Login          LoginOptions   `group:"Login Throttling Options"`
 }
 
 type LogsOptions struct {
@@ -22,12 +27,14 @@ type LogsOptions struct {
 	AddSystemInfo bool   `long:"logsysinfo" description:"Include hostname and pid on logs"`
 }
 type RethinkOptions struct {
-	Hosts      []string `short:"r" long:"rethinkdb" description:"RethinkDB host[:port]" default:"localhost:28015"`
-	Database   string   `short:"d" long:"database" description:"RethinkDB database" default:"nexus"`
-	MaxIdle    int      `long:"maxidle" description:"Max RethinkDB idle connections" default:"50"`
-	MaxOpen    int      `long:"maxopen" description:"Max RethinkDB open connections" default:"200"`
-	DefPipeLen int      `long:"defpipelen" description:"Default pipe length" default:"1000"`
-	MaxPipeLen int      `long:"maxpipelen" description:"Max pipe length" default:"100000"`
+	Hosts        []string `short:"r" long:"rethinkdb" description:"RethinkDB host[:port]" default:"localhost:28015"`
+	Database     string   `short:"d" long:"database" description:"RethinkDB database" default:"nexus"`
+	MaxIdle      int      `long:"maxidle" description:"Max RethinkDB idle connections" default:"50"`
+	MaxOpen      int      `long:"maxopen" description:"Max RethinkDB open connections" default:"200"`
+	DefPipeLen   int      `long:"defpipelen" description:"Default pipe length" default:"1000"`
+	MaxPipeLen   int      `long:"maxpipelen" description:"Max pipe length" default:"100000"`
+	DefPipeGrace int      `long:"defpipegrace" description:"Default grace period in seconds of resumable pipes" default:"60"`
+	MaxPipeGrace int      `long:"maxpipegrace" description:"Max grace period in seconds of resumable pipes" default:"3600"`
 }
 
 type SSLOptions struct {
@@ -35,6 +42,26 @@ type SSLOptions struct {
 	Key  string `long:"sslKey" description:"SSL Key" default:"nexus.key"`
 }
 
+type PassOptions struct {
+	Algorithm     string `long:"passhash" description:"Password hashing algorithm (scrypt|argon2id|bcrypt). Weaker hashes are upgraded on login" default:"scrypt"`
+	ScryptN       int    `long:"scryptn" description:"Scrypt CPU/memory cost, a power of two" default:"32768"`
+	ScryptR       int    `long:"scryptr" description:"Scrypt block size" default:"8"`
+	ScryptP       int    `long:"scryptp" description:"Scrypt parallelization" default:"1"`
+	Argon2Time    uint32 `long:"argon2time" description:"Argon2id passes over the memory" default:"3"`
+	Argon2Memory  uint32 `long:"argon2memory" description:"Argon2id memory in KiB" default:"65536"`
+	Argon2Threads int    `long:"argon2threads" description:"Argon2id threads" default:"2"`
+	BcryptCost    int    `long:"bcryptcost" description:"Bcrypt cost. Passwords are limited to 72 bytes with bcrypt" default:"12"`
+}
+
+type LoginOptions struct {
+	MaxUserFailures int `long:"loginmaxfailures" description:"Failed logins of a user before locking it out, 0 never does" default:"5"`
+	MaxAddrFailures int `long:"loginmaxaddrfailures" description:"Failed logins from a remote address before locking it out, 0 never does" default:"50"`
+	Lockout         int `long:"loginlockout" description:"Seconds a user or remote address stays locked out" default:"300"`
+	Window          int `long:"loginwindow" description:"Seconds after the last failed login when the failures are forgotten" default:"900"`
+	Delay           int `long:"logindelay" description:"Milliseconds the answer of a failed login is delayed, doubled on every further failure" default:"200"`
+	MaxDelay        int `long:"loginmaxdelay" description:"Max milliseconds the answer of a failed login is delayed" default:"5000"`
+}
+
 func parseOptions() {
 	_, err := flags.Parse(&opts)
 	if err != nil {
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jaracil/ei"
+	. "github.com/jaracil/nexus/log"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Passwords are stored encoded with their algorithm and parameters:
+//   $scrypt$n=16384,r=8,p=1$<salt>$<key>
+//   $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+//   $2a$10$<bcrypt salt and hash>
+// Users created before the encoded format have a hex scrypt key and a separate salt.
+// bcrypt only hashes the first 72 bytes of a password, so no longer ones are accepted with it.
+
+const (
+	PassScrypt   = "scrypt"
+	PassArgon2id = "argon2id"
+	PassBcrypt   = "bcrypt"
+
+	_passSaltLen = 16
+	_passKeyLen  = 32
+
+	// bcrypt ignores the bytes of a password after the first 72
+	_passBcryptMaxLen = 72
+)
+
+var passB64 = base64.RawStdEncoding
+
+type PassParams struct {
+	Algorithm string
+	N, R, P   int    // scrypt
+	M, T      uint32 // argon2id, which uses P for threads
+	Cost      int    // bcrypt
+	KeyLen    int
+}
+
+// Target settings of the stored passwords, from the command line options
+func passTarget() PassParams {
+	o := opts.PassHash
+	return PassParams{
+		Algorithm: strings.ToLower(o.Algorithm),
+		N:         o.ScryptN,
+		R:         o.ScryptR,
+		P:         o.ScryptP,
+		M:         o.Argon2Memory,
+		T:         o.Argon2Time,
+		Cost:      o.BcryptCost,
+		KeyLen:    _passKeyLen,
+	}
+}
+
+func checkPassHashOptions() error {
+	t := passTarget()
+	if t.Algorithm == PassArgon2id {
+		t.P = opts.PassHash.Argon2Threads
+	}
+	return checkPassParams(t)
+}
+
+// Check the parameters of a hash can be used, as the hashing functions fail or panic with some of them
+func checkPassParams(p PassParams) error {
+	switch p.Algorithm {
+	case PassScrypt:
+		if p.N < 2 || p.N&(p.N-1) != 0 || p.R <= 0 || p.P <= 0 {
+			return fmt.Errorf("invalid scrypt parameters n=%d r=%d p=%d", p.N, p.R, p.P)
+		}
+	case PassArgon2id:
+		if p.M < 8 || p.T <= 0 || p.P <= 0 || p.P > 255 {
+			return fmt.Errorf("invalid argon2id parameters m=%d t=%d p=%d", p.M, p.T, p.P)
+		}
+	case PassBcrypt:
+		if p.Cost < bcrypt.MinCost || p.Cost > bcrypt.MaxCost {
+			return fmt.Errorf("invalid bcrypt cost %d", p.Cost)
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// Longest password accepted, which is shorter when they are hashed with bcrypt
+func passMaxLen() int {
+	if passTarget().Algorithm == PassBcrypt {
+		return _passBcryptMaxLen
+	}
+	return _passwordMaxLen
+}
+
+// Hash a password with the target settings
+func EncodePass(pass string) (string, error) {
+	t := passTarget()
+	if len(pass) > passMaxLen() {
+		return "", errors.New("password too long")
+	}
+	if t.Algorithm == PassBcrypt {
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), t.Cost)
+		if err != nil {
+			return "", errors.New("bcrypt error")
+		}
+		return string(h), nil
+	}
+	salt := make([]byte, _passSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.New("Invalid salt")
+	}
+	switch t.Algorithm {
+	case PassArgon2id:
+		threads := uint8(opts.PassHash.Argon2Threads)
+		key := argon2.IDKey([]byte(pass), salt, t.T, t.M, threads, uint32(t.KeyLen))
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", PassArgon2id, argon2.Version, t.M, t.T, threads, passB64.EncodeToString(salt), passB64.EncodeToString(key)), nil
+	default:
+		key, err := scrypt.Key([]byte(pass), salt, t.N, t.R, t.P, t.KeyLen)
+		if err != nil {
+			return "", errors.New("scrypt error")
+		}
+		return fmt.Sprintf("$%s$n=%d,r=%d,p=%d$%s$%s", PassScrypt, t.N, t.R, t.P, passB64.EncodeToString(salt), passB64.EncodeToString(key)), nil
+	}
+}
+
+// Parse the algorithm and parameters of an encoded password
+func decodePass(encoded string) (p PassParams, salt []byte, key []byte, err error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 4 || fields[0] != "" {
+		return p, nil, nil, errors.New("invalid password encoding")
+	}
+	switch fields[1] {
+	case PassScrypt:
+		if len(fields) != 5 {
+			return p, nil, nil, errors.New("invalid scrypt encoding")
+		}
+		p.Algorithm = PassScrypt
+		if _, err = fmt.Sscanf(fields[2], "n=%d,r=%d,p=%d", &p.N, &p.R, &p.P); err != nil {
+			return
+		}
+		fields = fields[3:]
+	case PassArgon2id:
+		if len(fields) != 6 {
+			return p, nil, nil, errors.New("invalid argon2id encoding")
+		}
+		p.Algorithm = PassArgon2id
+		var version int
+		if _, err = fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+			return
+		}
+		if version != argon2.Version {
+			return p, nil, nil, errors.New("unsupported argon2 version")
+		}
+		if _, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.M, &p.T, &p.P); err != nil {
+			return
+		}
+		fields = fields[4:]
+	default:
+		cost, cerr := bcrypt.Cost([]byte(encoded))
+		if cerr != nil {
+			return p, nil, nil, cerr
+		}
+		p.Algorithm = PassBcrypt
+		p.Cost = cost
+		return p, nil, nil, nil
+	}
+	if salt, err = passB64.DecodeString(fields[0]); err != nil {
+		return
+	}
+	if key, err = passB64.DecodeString(fields[1]); err != nil {
+		return
+	}
+	if len(salt) == 0 || len(key) == 0 {
+		return p, nil, nil, errors.New("invalid password salt or key")
+	}
+	if err = checkPassParams(p); err != nil {
+		return p, nil, nil, err
+	}
+	p.KeyLen = len(key)
+	return p, salt, key, nil
+}
+
+// Return whether a password hashed with p is weaker than the target settings
+func passWeaker(p PassParams, t PassParams) bool {
+	if p.Algorithm != t.Algorithm {
+		return true
+	}
+	switch p.Algorithm {
+	case PassScrypt:
+		return p.N < t.N || p.R < t.R || p.P < t.P || p.KeyLen < t.KeyLen
+	case PassArgon2id:
+		return p.M < t.M || p.T < t.T || p.P < opts.PassHash.Argon2Threads || p.KeyLen < t.KeyLen
+	case PassBcrypt:
+		return p.Cost < t.Cost
+	}
+	return true
+}
+
+// Check a password against the stored one, telling whether it should be stored again with the target settings
+func VerifyPass(pass string, ud *UserData) (ok bool, rehash bool, err error) {
+	if !strings.HasPrefix(ud.Pass, "$") {
+		dk, err := HashPass(pass, ud.Salt)
+		if err != nil {
+			return false, false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(dk), []byte(ud.Pass)) == 1, true, nil
+	}
+	p, salt, key, err := decodePass(ud.Pass)
+	if err != nil {
+		return false, false, err
+	}
+	switch p.Algorithm {
+	case PassBcrypt:
+		// Longer passwords would match on their first bytes only
+		if len(pass) > _passBcryptMaxLen {
+			return false, false, nil
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(ud.Pass), []byte(pass)); err != nil {
+			return false, false, nil
+		}
+	case PassArgon2id:
+		dk := argon2.IDKey([]byte(pass), salt, p.T, p.M, uint8(p.P), uint32(len(key)))
+		if subtle.ConstantTimeCompare(dk, key) != 1 {
+			return false, false, nil
+		}
+	default:
+		dk, err := scrypt.Key([]byte(pass), salt, p.N, p.R, p.P, len(key))
+		if err != nil {
+			return false, false, errors.New("scrypt error")
+		}
+		if subtle.ConstantTimeCompare(dk, key) != 1 {
+			return false, false, nil
+		}
+	}
+	// Passwords too long for the target settings can't be stored again
+	return true, passWeaker(p, passTarget()) && len(pass) <= passMaxLen(), nil
+}
+
+// Store again a verified password with the target settings, unless it has been changed meanwhile
+func rehashPass(ud *UserData, pass string) {
+	hp, err := EncodePass(pass)
+	if err == nil {
+		_, err = r.Table("users").
+			Get(ud.User).
+			Update(func(u r.Term) interface{} {
+				return r.Branch(u.Field("pass").Eq(ud.Pass), ei.M{"salt": r.Literal(), "pass": hp}, ei.M{})
+			}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+	}
+	if err != nil {
+		Log.WithFields(logrus.Fields{
+			"user":  ud.User,
+			"error": err.Error(),
+		}).Errorf("Error upgrading password hash")
+	}
+}
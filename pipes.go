@@ -1,12 +1,15 @@
 package main
 
 import (
-	"strings"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jaracil/ei"
 	. "github.com/jaracil/nexus/log"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
 	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
 )
 
@@ -16,18 +19,590 @@ type Pipe struct {
 	Count        int64       `gorethink:"count"`
 	IsMsg        bool        `gorethink:"ismsg"`
 	CreationTime interface{} `gorethink:"creationTime,omitempty"`
+	Owner        string      `gorethink:"owner,omitempty"`
+	Resumable    bool        `gorethink:"resumable,omitempty"`
+	Token        string      `gorethink:"token,omitempty"`
+	Grace        int         `gorethink:"grace,omitempty"`
+	Len          int         `gorethink:"len,omitempty"`
+	Overflow     string      `gorethink:"overflow,omitempty"`
+	BlockTimeout float64     `gorethink:"blocktimeout,omitempty"`
+	AckTimeout   float64     `gorethink:"acktimeout,omitempty"`
+	Holder       string      `gorethink:"holder,omitempty"`
 }
 
+// Time to wait for the node holding a pipe to hand it off
+const _pipeHandoffTimeout = time.Second * 5
+
+// Pipe overflow policies
+const (
+	OverflowDropNew = "dropnew"
+	OverflowDropOld = "dropold"
+	OverflowBlock   = "block"
+)
+
 type PipeFeed struct {
 	Old *Pipe `gorethink:"old_val"`
 	New *Pipe `gorethink:"new_val"`
 }
 
+// Node side state of the pipes held by this node
+type LocalPipe struct {
+	*sync.Mutex
+	Owner      string
+	Capacity   int
+	AckTimeout time.Duration
+	Pending    map[int64]*PendingMsg
+	Readers    int64
+	Overflow   string
+	Last       int64
+	ReadMark   int64 // Read count last written on the pipe row
+	Credit     int64
+	wake       chan struct{}
+	streamCtx  context.Context
+	stopStream context.CancelFunc
+	loading    bool    // Messages stored on the database are being loaded
+	backlog    []*Pipe // Messages received while loading
+}
+
+// Message read from an ack mode pipe which has not been acknowledged yet
+type PendingMsg struct {
+	Msg      interface{}
+	Deadline time.Time
+}
+
+func newLocalPipe(owner string, capacity int, ackTimeout time.Duration, overflow string) *LocalPipe {
+	return &LocalPipe{
+		Mutex:      &sync.Mutex{},
+		Owner:      owner,
+		Capacity:   capacity,
+		AckTimeout: ackTimeout,
+		Pending:    map[int64]*PendingMsg{},
+		Overflow:   overflow,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+type LocalPipes struct {
+	*sync.RWMutex
+	Map map[string]*LocalPipe
+}
+
+var localPipes = &LocalPipes{
+	&sync.RWMutex{},
+	map[string]*LocalPipe{},
+}
+
+func (lp *LocalPipes) Get(pipeid string) *LocalPipe {
+	lp.RLock()
+	defer lp.RUnlock()
+	return lp.Map[pipeid]
+}
+
+func (lp *LocalPipes) Set(pipeid string, p *LocalPipe) {
+	lp.Lock()
+	lp.Map[pipeid] = p
+	lp.Unlock()
+}
+
+func (lp *LocalPipes) Del(pipeid string) {
+	lp.Lock()
+	delete(lp.Map, pipeid)
+	lp.Unlock()
+}
+
+func (p *LocalPipe) GetOwner() string {
+	p.Lock()
+	defer p.Unlock()
+	return p.Owner
+}
+
+func (p *LocalPipe) SetOwner(owner string) {
+	p.Lock()
+	p.Owner = owner
+	p.Unlock()
+}
+
+func (p *LocalPipe) AckMode() bool {
+	return p.AckTimeout > 0
+}
+
+// Return a message read from the pipe, keeping it pending of acknowledgement on ack mode
+func (p *LocalPipe) Deliver(pipe *Pipe) map[string]interface{} {
+	if p.AckMode() {
+		p.Lock()
+		p.Pending[pipe.Count] = &PendingMsg{pipe.Msg, time.Now().Add(p.AckTimeout)}
+		p.Unlock()
+	}
+	return map[string]interface{}{"msg": pipe.Msg, "count": pipe.Count}
+}
+
+// Return up to max pending messages whose acknowledgement timed out
+func (p *LocalPipe) Redeliver(max int) []interface{} {
+	res := make([]interface{}, 0)
+	if !p.AckMode() || max <= 0 {
+		return res
+	}
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	counts := make([]int64, 0)
+	for count, pm := range p.Pending {
+		if !pm.Deadline.After(now) {
+			counts = append(counts, count)
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+	if len(counts) > max {
+		counts = counts[:max]
+	}
+	for _, count := range counts {
+		pm := p.Pending[count]
+		pm.Deadline = now.Add(p.AckTimeout)
+		res = append(res, map[string]interface{}{"msg": pm.Msg, "count": count, "redelivered": true})
+	}
+	return res
+}
+
+// Return the time left until the next pending message must be redelivered
+func (p *LocalPipe) NextRedelivery() (time.Duration, bool) {
+	if !p.AckMode() {
+		return 0, false
+	}
+	p.Lock()
+	defer p.Unlock()
+	var next time.Time
+	for _, pm := range p.Pending {
+		if next.IsZero() || pm.Deadline.Before(next) {
+			next = pm.Deadline
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	return time.Until(next), true
+}
+
+// Unacknowledged messages are limited to the pipe capacity
+func (p *LocalPipe) CanDeliver() bool {
+	if !p.AckMode() {
+		return true
+	}
+	p.Lock()
+	defer p.Unlock()
+	return len(p.Pending) < p.Capacity
+}
+
+func (p *LocalPipe) Ack(counts []int64) int {
+	p.Lock()
+	defer p.Unlock()
+	acked := 0
+	for _, count := range counts {
+		if _, ok := p.Pending[count]; ok {
+			delete(p.Pending, count)
+			acked++
+		}
+	}
+	if acked > 0 {
+		p.Wake()
+	}
+	return acked
+}
+
+// Wake up the stream of the pipe, if any, to recheck its state
+func (p *LocalPipe) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start pushing the pipe messages to nc, or add credit if it is already streaming to it
+func (p *LocalPipe) Stream(nc *NexusConn, pipeid string, credit int64) int64 {
+	p.Lock()
+	if p.stopStream == nil {
+		p.streamCtx, p.stopStream = context.WithCancel(nc.context)
+		go nc.pipeStream(p.streamCtx, pipeid, p)
+	}
+	p.Unlock()
+	total := atomic.AddInt64(&p.Credit, credit)
+	p.Wake()
+	return total
+}
+
+func (p *LocalPipe) StopStream() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.endStream(p.streamCtx)
+}
+
+// Must be called with the lock held. Only ends the stream running with ctx
+func (p *LocalPipe) endStream(ctx context.Context) bool {
+	if p.stopStream == nil || p.streamCtx != ctx {
+		return false
+	}
+	p.stopStream()
+	p.stopStream = nil
+	p.streamCtx = nil
+	atomic.StoreInt64(&p.Credit, 0)
+	return true
+}
+
+// Push the pipe messages as pipe.msg notifications while there is credit left
+func (nc *NexusConn) pipeStream(ctx context.Context, pipeid string, p *LocalPipe) {
+	defer func() {
+		p.Lock()
+		p.endStream(ctx)
+		p.Unlock()
+	}()
+	ch, err := sesNotify.Channel(pipeid)
+	if err != nil {
+		return
+	}
+	push := func(m map[string]interface{}) bool {
+		m["pipeid"] = pipeid
+		m["drops"], _ = sesNotify.Drops(pipeid, true)
+		atomic.AddInt64(&p.Credit, -1)
+		return nc.pushNotif("pipe.msg", m) == nil
+	}
+	for {
+		credit := atomic.LoadInt64(&p.Credit)
+		if credit <= 0 {
+			select {
+			case <-p.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		for _, m := range p.Redeliver(int(credit)) {
+			if !push(m.(map[string]interface{})) {
+				return
+			}
+		}
+		if atomic.LoadInt64(&p.Credit) <= 0 {
+			continue
+		}
+		readCh := ch
+		if !p.CanDeliver() {
+			readCh = nil
+		}
+		var redeliverCh <-chan time.Time
+		if next, ok := p.NextRedelivery(); ok {
+			redeliverCh = time.After(next)
+		}
+		select {
+		case m, ok := <-readCh:
+			if !ok {
+				return
+			}
+			if !push(p.Deliver(m.(*Pipe))) {
+				return
+			}
+			p.UpdateRead(pipeid)
+		case <-redeliverCh:
+		case <-p.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *LocalPipe) PendingLen() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.Pending)
+}
+
+// Keep back a message received while the stored ones are loaded. Returns false when not loading.
+func (p *LocalPipe) Hold(pipe *Pipe) bool {
+	p.Lock()
+	defer p.Unlock()
+	if !p.loading {
+		return false
+	}
+	p.backlog = append(p.backlog, pipe)
+	return true
+}
+
+// Queue the messages kept back while loading the ones stored up to count
+func (p *LocalPipe) Loaded(pipeid string, count int64) {
+	p.Lock()
+	defer p.Unlock()
+	atomic.StoreInt64(&p.Last, count)
+	for _, pipe := range p.backlog {
+		if pipe.Count > count {
+			atomic.StoreInt64(&p.Last, pipe.Count)
+			sesNotify.Notify(pipeid, pipe)
+		}
+	}
+	p.backlog = nil
+	p.loading = false
+}
+
+// Let blocked writers know how much room is left on a block overflow pipe. The pipe row
+// is only written when writers may be blocked, as it was full at the last written mark.
+func (p *LocalPipe) UpdateRead(pipeid string) {
+	if p.Overflow != OverflowBlock {
+		return
+	}
+	last := atomic.LoadInt64(&p.Last)
+	if last-atomic.LoadInt64(&p.ReadMark) < int64(p.Capacity) {
+		return
+	}
+	waiting, err := sesNotify.Waiting(pipeid)
+	if err != nil {
+		return
+	}
+	read := last - int64(waiting)
+	atomic.StoreInt64(&p.ReadMark, read)
+	r.Table("pipes").
+		Get(pipeid).
+		Update(map[string]interface{}{"read": read, "ismsg": false, "msg": nil}).
+		RunWrite(db, r.RunOpts{Durability: "soft"})
+}
+
+type PipeWaiter struct {
+	ch        chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+	waiters   int
+	cancel    context.CancelFunc
+}
+
+// Writers waiting for room on a pipe, and readers of shared pipes waiting for messages, share
+// a changefeed on the pipe row, open while any of them waits
+type PipeWaiters struct {
+	*sync.Mutex
+	Map map[string]*PipeWaiter
+}
+
+var pipeWaiters = &PipeWaiters{&sync.Mutex{}, map[string]*PipeWaiter{}}
+
+// Start waiting on the changes of a pipe row. Returns a function returning a channel which is closed
+// on the next change, and the function to call when done waiting. Changes are followed once it returns.
+func (w *PipeWaiters) Wait(pipeid string) (func() <-chan struct{}, func()) {
+	w.Lock()
+	pw, ok := w.Map[pipeid]
+	if !ok {
+		ctx, cancel := context.WithCancel(mainContext)
+		pw = &PipeWaiter{ch: make(chan struct{}), ready: make(chan struct{}), cancel: cancel}
+		w.Map[pipeid] = pw
+		go w.track(ctx, pipeid, pw)
+	}
+	pw.waiters++
+	w.Unlock()
+	<-pw.ready
+	next := func() <-chan struct{} {
+		w.Lock()
+		defer w.Unlock()
+		return pw.ch
+	}
+	return next, func() {
+		w.Lock()
+		defer w.Unlock()
+		pw.waiters--
+		if pw.waiters <= 0 && w.Map[pipeid] == pw {
+			pw.cancel()
+			delete(w.Map, pipeid)
+		}
+	}
+}
+
+func (w *PipeWaiters) wake(pw *PipeWaiter) {
+	w.Lock()
+	defer w.Unlock()
+	close(pw.ch)
+	pw.ch = make(chan struct{})
+}
+
+// Wake up the waiters on every change of the pipe row. When the changefeed fails they are woken
+// up after a second, to check the pipe again while it's reopened.
+func (w *PipeWaiters) track(ctx context.Context, pipeid string, pw *PipeWaiter) {
+	defer pw.readyOnce.Do(func() { close(pw.ready) })
+	for ctx.Err() == nil {
+		iter, err := r.Table("pipes").
+			Get(pipeid).
+			Changes(r.ChangesOpts{Squash: false}).
+			Run(db, r.RunOpts{Context: ctx})
+		pw.readyOnce.Do(func() { close(pw.ready) })
+		if err == nil {
+			var change interface{}
+			for iter.Next(&change) {
+				w.wake(pw)
+			}
+			err = iter.Err()
+			iter.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		Log.WithFields(logrus.Fields{
+			"pipeid": pipeid,
+			"error":  err,
+		}).Errorf("Error following pipe changefeed")
+		select {
+		case <-time.After(time.Second):
+			w.wake(pw)
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Update of a pipe row writing msg on it. Pipes held by no node, while they are handed off to another
+// one, count the message on their size instead, and pipesWrite stores it on pipemsgs.
+func pipeMsgUpdate(p r.Term, msg interface{}) r.Term {
+	size := p.Field("size").Default(0)
+	return r.Branch(
+		p.HasFields("holder"),
+		map[string]interface{}{"msg": r.Literal(msg), "count": p.Field("count").Add(1), "ismsg": true},
+		size.Lt(p.Field("len")),
+		map[string]interface{}{"count": p.Field("count").Add(1), "size": size.Add(1), "ismsg": false, "msg": nil},
+		p.Field("overflow").Default("").Eq(OverflowDropOld),
+		map[string]interface{}{"count": p.Field("count").Add(1), "drops": p.Field("drops").Default(0).Add(1), "ismsg": false, "msg": nil},
+		map[string]interface{}{"drops": p.Field("drops").Default(0).Add(1)},
+	)
+}
+
+// Update of a pipe row writing msg on it, unless it's a full block overflow pipe
+func pipeWriteTerm(p r.Term, msg interface{}) r.Term {
+	used := r.Branch(p.HasFields("holder"), p.Field("count").Sub(p.Field("read").Default(0)), p.Field("size").Default(0))
+	return r.Branch(
+		p.Field("overflow").Default("").Eq(OverflowBlock).And(used.Ge(p.Field("len"))),
+		map[string]interface{}{},
+		pipeMsgUpdate(p, msg),
+	)
+}
+
+// Write msg on the pipes selected by sel with update, then store it on pipemsgs for the pipes which
+// counted it on their size. Dropold pipes which were full lose their oldest stored message.
+func pipesWrite(sel r.Term, msg interface{}, update func(r.Term) interface{}) r.Term {
+	return sel.
+		Update(update, r.UpdateOpts{ReturnChanges: true}).
+		Do(func(res r.Term) interface{} {
+			return res.Field("changes").Default(ei.S{}).
+				Filter(func(c r.Term) interface{} {
+					return c.Field("new_val").HasFields("holder").Not().
+						And(c.Field("new_val").Field("count").Gt(c.Field("old_val").Field("count")))
+				}).
+				ForEach(func(c r.Term) interface{} {
+					pipe := c.Field("new_val")
+					insert := r.Table("pipemsgs").Insert(ei.M{"id": r.Expr(ei.S{pipe.Field("id"), pipe.Field("count")}), "msg": msg})
+					return r.Branch(pipe.Field("size").Gt(c.Field("old_val").Field("size").Default(0)), insert,
+						insert.Do(func(r.Term) interface{} {
+							return r.Table("pipemsgs").
+								Between(r.Expr(ei.S{pipe.Field("id"), r.MinVal}), r.Expr(ei.S{pipe.Field("id"), r.MaxVal})).
+								OrderBy(r.OrderByOpts{Index: "id"}).
+								Limit(1).
+								Delete()
+						}))
+				}).
+				Do(func(r.Term) interface{} {
+					return res.Without("changes")
+				})
+		})
+}
+
+// Delete the pipes selected by sel along with the messages they keep on pipemsgs
+func pipesDelete(sel r.Term) r.Term {
+	return sel.
+		Delete(r.DeleteOpts{ReturnChanges: true}).
+		Do(func(res r.Term) interface{} {
+			return res.Field("changes").Default(ei.S{}).
+				ForEach(func(c r.Term) interface{} {
+					pipeid := c.Field("old_val").Field("id")
+					return r.Table("pipemsgs").Between(r.Expr(ei.S{pipeid, r.MinVal}), r.Expr(ei.S{pipeid, r.MaxVal})).Delete()
+				}).
+				Do(func(r.Term) interface{} {
+					return res.Without("changes")
+				})
+		})
+}
+
+// Write a message into a pipe. Block overflow pipes make the writer wait for room until their timeout expires
+func pipeWrite(ctx context.Context, pipeid string, msg interface{}) (int, error) {
+	if isSharedPipe(pipeid) {
+		return sharedPipeWrite(pipeid, msg)
+	}
+	var deadline time.Time
+	var next func() <-chan struct{}
+	for {
+		var wake <-chan struct{}
+		if next != nil {
+			wake = next()
+		}
+		res, err := pipesWrite(r.Table("pipes").Get(pipeid), msg, func(p r.Term) interface{} {
+			return pipeWriteTerm(p, msg)
+		}).RunWrite(db, r.RunOpts{Durability: "soft"})
+		if err != nil {
+			return ErrInternal, err
+		}
+		if res.Replaced > 0 {
+			return ErrNoError, nil
+		}
+		if res.Unchanged <= 0 {
+			return ErrInvalidPipe, nil
+		}
+		if next == nil {
+			// Try again once waiting, in case the readers made room meanwhile
+			cur, err := r.Table("pipes").Get(pipeid).Field("blocktimeout").Default(0).Run(db)
+			if err != nil {
+				return ErrInternal, err
+			}
+			var timeout float64
+			cur.One(&timeout)
+			cur.Close()
+			deadline = time.Now().Add(time.Duration(timeout * float64(time.Second)))
+			var done func()
+			next, done = pipeWaiters.Wait(pipeid)
+			defer done()
+			continue
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return ErrTimeout, nil
+		}
+		select {
+		case <-wake:
+		case <-time.After(left):
+			return ErrTimeout, nil
+		case <-ctx.Done():
+			return ErrCancel, nil
+		}
+	}
+}
+
+// Return the local pipe when it's owned by the connection, nil otherwise
+func (nc *NexusConn) ownedPipe(pipeid string) *LocalPipe {
+	if p := localPipes.Get(pipeid); p != nil && p.GetOwner() == nc.connId {
+		return p
+	}
+	return nil
+}
+
+func pipePurge() {
+	defer exit("pipe purge goroutine error")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if isMasterNode() {
+				// Delete detached resumable pipes whose grace period expired
+				pipesDelete(r.Table("pipes").Between(r.MinVal, r.Now(), r.BetweenOpts{Index: "expires"})).
+					RunWrite(db, r.RunOpts{Durability: "soft"})
+			}
+		case <-mainContext.Done():
+			return
+		}
+	}
+}
+
+// Follow the pipes held by this node, feeding their buffers with the messages written on them
 func pipeTrack() {
 	defer exit("pipe change-feed error")
 	for retry := 0; retry < 10; retry++ {
 		iter, err := r.Table("pipes").
-			Between(nodeId, nodeId+"\uffff").
+			Between(nodeId, nodeId, r.BetweenOpts{Index: "holder", RightBound: "closed"}).
 			Changes(r.ChangesOpts{IncludeInitial: true, Squash: false}).
 			Pluck(map[string]interface{}{
 				"new_val": []string{"id", "msg", "count", "ismsg"},
@@ -50,18 +625,217 @@ func pipeTrack() {
 				iter.Close()
 				break
 			}
-			if pf.New == nil { // Deleted pipe
-				sesNotify.Unregister(pf.Old.Id)
+			if pf.New == nil { // Deleted pipe, or held by another node
+				pipeRelease(pf.Old.Id)
 				continue
 			}
 			if pf.New.IsMsg {
+				p := localPipes.Get(pf.New.Id)
+				if p != nil && p.Hold(pf.New) {
+					continue
+				}
+				// Readers must not see a message before it's counted as the last one
+				if p != nil {
+					atomic.StoreInt64(&p.Last, pf.New.Count)
+				}
 				sesNotify.Notify(pf.New.Id, pf.New)
 			}
 		}
 	}
 }
 
+// Drop the state of a pipe which is no longer held by this node. When it's handed off to another
+// node, the messages left on its buffer are stored on pipemsgs for the new holder to load them.
+func pipeRelease(pipeid string) {
+	p := localPipes.Get(pipeid)
+	if p == nil {
+		return
+	}
+	localPipes.Del(pipeid)
+	p.StopStream()
+	ch, err := sesNotify.Channel(pipeid)
+	if err != nil {
+		return
+	}
+	drops, _ := sesNotify.Drops(pipeid, true)
+	sesNotify.Unregister(pipeid)
+	msgs := make([]interface{}, 0)
+	p.Lock()
+	for count, pm := range p.Pending {
+		msgs = append(msgs, map[string]interface{}{"id": ei.S{pipeid, count}, "msg": pm.Msg})
+	}
+	p.Unlock()
+	for m := range ch {
+		pipe := m.(*Pipe)
+		msgs = append(msgs, map[string]interface{}{"id": ei.S{pipeid, pipe.Count}, "msg": pipe.Msg})
+	}
+	p.Lock()
+	for _, pipe := range p.backlog {
+		msgs = append(msgs, map[string]interface{}{"id": ei.S{pipeid, pipe.Count}, "msg": pipe.Msg})
+	}
+	p.backlog = nil
+	p.Unlock()
+	_, err = r.Table("pipes").
+		Get(pipeid).
+		Do(func(pipe r.Term) interface{} {
+			return r.Branch(pipe.Field("handoff").Default("").Eq(nodeId),
+				r.Table("pipemsgs").Insert(msgs, r.InsertOpts{Conflict: "replace"}).Do(func(r.Term) interface{} {
+					return r.Table("pipes").Get(pipeid).Update(func(pipe r.Term) interface{} {
+						return map[string]interface{}{
+							"handoff": r.Literal(),
+							"size":    pipe.Field("size").Default(0).Add(len(msgs)),
+							"drops":   pipe.Field("drops").Default(0).Add(drops),
+						}
+					})
+				}),
+				map[string]interface{}{})
+		}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	if err != nil {
+		Log.WithFields(logrus.Fields{
+			"pipeid": pipeid,
+			"error":  err.Error(),
+		}).Errorf("Error storing the buffer of a pipe handed off")
+	}
+}
+
+// Wait until the node holding a pipe has stored its buffer on pipemsgs
+func pipeHandedOff(ctx context.Context, pipeid string, holder string) bool {
+	cur, err := r.Table("pipes").
+		Get(pipeid).
+		Changes(r.ChangesOpts{IncludeInitial: true}).
+		Filter(func(c r.Term) interface{} {
+			return c.Field("new_val").Field("handoff").Default("").Ne(holder)
+		}).
+		Run(db, r.RunOpts{Context: ctx})
+	if err != nil {
+		return false
+	}
+	defer cur.Close()
+	var change interface{}
+	return cur.Next(&change)
+}
+
+// Take the messages of a pipe stored on pipemsgs up to count. Writers count the messages on the
+// pipe before storing them, so it waits a moment for the n expected ones.
+func pipeStored(pipeid string, count int64, n int) ([]*Pipe, error) {
+	stored := r.Table("pipemsgs").Between(ei.S{pipeid, r.MinVal}, ei.S{pipeid, count}, r.BetweenOpts{RightBound: "closed"})
+	msgs := map[int64]*Pipe{}
+	if n > 0 {
+		ctx, cancel := context.WithTimeout(mainContext, time.Second)
+		cur, err := stored.
+			Changes(r.ChangesOpts{IncludeInitial: true}).
+			Field("new_val").
+			Run(db, r.RunOpts{Context: ctx})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		for len(msgs) < n {
+			var item map[string]interface{}
+			if !cur.Next(&item) {
+				break
+			}
+			if item != nil {
+				c := ei.N(item).M("id").S(1).Int64Z()
+				msgs[c] = &Pipe{Id: pipeid, Msg: item["msg"], Count: c, IsMsg: true}
+			}
+		}
+		cur.Close()
+		cancel()
+	}
+	_, err := stored.Delete().RunWrite(db, r.RunOpts{Durability: "soft"})
+	res := make([]*Pipe, 0, len(msgs))
+	for _, pipe := range msgs {
+		res = append(res, pipe)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Count < res[j].Count })
+	return res, err
+}
+
+// Take over a resumable pipe attached by the session while it's held by another node. That node stores
+// the pipe buffer on pipemsgs, which is loaded here along with the messages written meanwhile.
+func (nc *NexusConn) pipeLoad(pipeid string, pipe *Pipe, handoff string) (*LocalPipe, int) {
+	if handoff != "" {
+		ctx, cancel := context.WithTimeout(nc.context, _pipeHandoffTimeout)
+		done := pipeHandedOff(ctx, pipeid, handoff)
+		cancel()
+		if !done {
+			if nc.context.Err() != nil {
+				return nil, ErrCancel
+			}
+			// The buffer was lost with the node holding it
+			r.Table("pipes").
+				Get(pipeid).
+				Update(r.Branch(r.Row.Field("handoff").Default("").Eq(handoff), map[string]interface{}{"handoff": r.Literal()}, map[string]interface{}{})).
+				RunWrite(db, r.RunOpts{Durability: "soft"})
+		}
+	}
+	if _, err := sesNotify.Register(pipeid, make(chan interface{}, pipe.Len)); err != nil {
+		return nil, ErrInternal
+	}
+	sesNotify.SetDropOld(pipeid, pipe.Overflow == OverflowDropOld)
+	p := newLocalPipe(nc.connId, pipe.Len, time.Duration(pipe.AckTimeout*float64(time.Second)), pipe.Overflow)
+	p.loading = true
+	localPipes.Set(pipeid, p)
+	// Messages written from now on are received through pipeTrack, and kept back until the stored ones are loaded
+	res, err := r.Table("pipes").
+		Get(pipeid).
+		Update(func(pipe r.Term) interface{} {
+			return r.Branch(pipe.Field("owner").Default("").Eq(nc.connId).And(pipe.HasFields("holder").Not()),
+				map[string]interface{}{
+					"holder":  nodeId,
+					"handoff": r.Literal(),
+					"size":    0,
+					"drops":   0,
+					"read":    pipe.Field("count").Sub(pipe.Field("size").Default(0)),
+					"ismsg":   false,
+					"msg":     nil,
+				},
+				map[string]interface{}{})
+		}, r.UpdateOpts{ReturnChanges: true}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	if err != nil || res.Replaced <= 0 {
+		localPipes.Del(pipeid)
+		sesNotify.Unregister(pipeid)
+		if err != nil {
+			return nil, ErrInternal
+		}
+		return nil, ErrInvalidPipe
+	}
+	old := ei.N(res.Changes[0].OldValue)
+	count := old.M("count").Int64Z()
+	size := old.M("size").IntZ()
+	sesNotify.AddDrops(pipeid, old.M("drops").IntZ())
+	atomic.StoreInt64(&p.ReadMark, count-int64(size))
+	atomic.StoreInt64(&p.Last, count)
+	msgs, err := pipeStored(pipeid, count, size)
+	if err != nil {
+		Log.WithFields(logrus.Fields{
+			"pipeid": pipeid,
+			"error":  err.Error(),
+		}).Errorf("Error loading the stored messages of a pipe")
+	}
+	for _, m := range msgs {
+		sesNotify.Notify(pipeid, m)
+	}
+	p.Loaded(pipeid, count)
+	return p, ErrNoError
+}
+
 func (nc *NexusConn) handlePipeReq(req *JsonRpcReq) {
+	if shared := ei.N(req.Params).M("shared").RawZ(); shared != nil {
+		if _, ok := shared.(string); !ok {
+			req.Error(ErrInvalidParams, "shared", nil)
+			return
+		}
+	}
+	if ei.N(req.Params).M("shared").StringZ() != "" || isSharedPipe(ei.N(req.Params).M("pipeid").StringZ()) {
+		if req.Method != "pipe.write" {
+			nc.handleSharedPipeReq(req)
+			return
+		}
+	}
 	switch req.Method {
 	case "pipe.create":
 		pipeid := nc.connId + safeId(10)
@@ -72,11 +846,48 @@ func (nc *NexusConn) handlePipeReq(req *JsonRpcReq) {
 		if length > opts.Rethink.MaxPipeLen {
 			length = opts.Rethink.MaxPipeLen
 		}
+		resumable := ei.N(req.Params).M("resumable").BoolZ()
+		grace := 0
+		token := ""
+		if resumable {
+			grace = ei.N(req.Params).M("grace").IntZ()
+			if grace <= 0 {
+				grace = opts.Rethink.DefPipeGrace
+			}
+			if grace > opts.Rethink.MaxPipeGrace {
+				grace = opts.Rethink.MaxPipeGrace
+			}
+			token = safeId(16)
+		}
+		var ackTimeout time.Duration
+		if ei.N(req.Params).M("ack").BoolZ() {
+			ackTimeout = time.Second * 30
+			if t := ei.N(req.Params).M("acktimeout").Float64Z(); t > 0 {
+				ackTimeout = time.Duration(t * float64(time.Second))
+			}
+		}
+		overflow := ei.N(req.Params).M("overflow").StringZ()
+		if overflow == OverflowDropNew {
+			overflow = ""
+		}
+		if overflow != "" && overflow != OverflowDropOld && overflow != OverflowBlock {
+			req.Error(ErrInvalidParams, "overflow", nil)
+			return
+		}
+		blockTimeout := 0.0
+		if overflow == OverflowBlock {
+			blockTimeout = ei.N(req.Params).M("blocktimeout").Float64Z()
+			if blockTimeout <= 0 {
+				blockTimeout = 5
+			}
+		}
 		_, err := sesNotify.Register(pipeid, make(chan interface{}, length))
 		if err != nil {
 			req.Error(ErrInternal, "", nil)
 			return
 		}
+		sesNotify.SetDropOld(pipeid, overflow == OverflowDropOld)
+		localPipes.Set(pipeid, newLocalPipe(nc.connId, length, ackTimeout, overflow))
 
 		pipe := &Pipe{
 			Id:           pipeid,
@@ -84,22 +895,88 @@ func (nc *NexusConn) handlePipeReq(req *JsonRpcReq) {
 			Count:        0,
 			IsMsg:        false,
 			CreationTime: r.Now(),
+			Owner:        nc.connId,
+			Resumable:    resumable,
+			Token:        token,
+			Grace:        grace,
+			Len:          length,
+			Overflow:     overflow,
+			BlockTimeout: blockTimeout,
+			AckTimeout:   ackTimeout.Seconds(),
+			Holder:       nodeId,
 		}
 		_, err = r.Table("pipes").Insert(pipe).RunWrite(db, r.RunOpts{Durability: "hard"})
 		if err != nil {
 			sesNotify.Unregister(pipeid)
+			localPipes.Del(pipeid)
 			req.Error(ErrInternal, "", nil)
 			return
 		}
-		req.Result(map[string]interface{}{"pipeid": pipeid})
+		if resumable {
+			req.Result(map[string]interface{}{"pipeid": pipeid, "token": token})
+		} else {
+			req.Result(map[string]interface{}{"pipeid": pipeid})
+		}
+	case "pipe.attach":
+		pipeid := ei.N(req.Params).M("pipeid").StringZ()
+		if pipeid == "" {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		token, err := ei.N(req.Params).M("token").String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "token", nil)
+			return
+		}
+		// Pipes held by another node are handed off to this one. Their holder is kept on the
+		// handoff field until it stores the pipe buffer on pipemsgs.
+		res, err := r.Table("pipes").
+			Get(pipeid).
+			Update(func(pipe r.Term) interface{} {
+				holder := pipe.Field("holder").Default("")
+				attach := map[string]interface{}{"owner": nc.connId, "attachTime": r.Now(), "expires": r.Literal(), "ismsg": false, "msg": nil}
+				handoff := map[string]interface{}{"owner": nc.connId, "attachTime": r.Now(), "expires": r.Literal(), "ismsg": false, "msg": nil,
+					"holder": r.Literal(), "handoff": r.Branch(holder.Eq(""), pipe.Field("handoff").Default(""), holder)}
+				return r.Branch(pipe.Field("resumable").Default(false).And(pipe.Field("token").Default("").Eq(token)),
+					r.Branch(holder.Eq(nodeId), attach, handoff),
+					map[string]interface{}{})
+			}, r.UpdateOpts{ReturnChanges: true}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		if res.Replaced <= 0 {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		pipe := ei.N(res.Changes[0].NewValue)
+		p := localPipes.Get(pipeid)
+		if pipe.M("holder").StringZ() == nodeId && p != nil {
+			p.SetOwner(nc.connId)
+		} else {
+			var code int
+			p, code = nc.pipeLoad(pipeid, &Pipe{
+				Len:        pipe.M("len").IntZ(),
+				Overflow:   pipe.M("overflow").StringZ(),
+				AckTimeout: pipe.M("acktimeout").Float64Z(),
+			}, pipe.M("handoff").StringZ())
+			if code != ErrNoError {
+				req.Error(code, "", nil)
+				return
+			}
+		}
+		waiting, _ := sesNotify.Waiting(pipeid)
+		req.Result(map[string]interface{}{"ok": true, "waiting": waiting})
 	case "pipe.close":
 		pipeid := ei.N(req.Params).M("pipeid").StringZ()
-		if pipeid == "" || !strings.HasPrefix(pipeid, nc.connId) {
+		if nc.ownedPipe(pipeid) == nil {
 			req.Error(ErrInvalidPipe, "", nil)
 			return
 		}
 		sesNotify.Unregister(pipeid)
-		res, err := r.Table("pipes").Get(pipeid).Delete().RunWrite(db, r.RunOpts{Durability: "hard"})
+		localPipes.Del(pipeid)
+		res, err := pipesDelete(r.Table("pipes").Get(pipeid)).RunWrite(db, r.RunOpts{Durability: "hard"})
 		if err != nil {
 			req.Error(ErrInternal, "", nil)
 			return
@@ -127,18 +1004,16 @@ func (nc *NexusConn) handlePipeReq(req *JsonRpcReq) {
 			}
 		}
 
-		for _, msg := range msgs {
-			res, err := r.Table("pipes").
-				Get(pipeid).
-				Update(map[string]interface{}{"msg": r.Literal(msg), "count": r.Row.Field("count").Add(1), "ismsg": true}).
-				RunWrite(db, r.RunOpts{Durability: "soft"})
-			if err != nil {
-				req.Error(ErrInternal, "", nil)
+		if isSharedPipe(pipeid) {
+			if _, code := nc.sharedPipe(pipeid, req.Method); code != ErrNoError {
+				req.Error(code, "", nil)
 				return
 			}
-
-			if res.Replaced <= 0 {
-				req.Error(ErrInvalidPipe, "", nil)
+		}
+		for _, msg := range msgs {
+			code, _ := pipeWrite(nc.context, pipeid, msg)
+			if code != ErrNoError {
+				req.Error(code, "", nil)
 				return
 			}
 		}
@@ -146,7 +1021,8 @@ func (nc *NexusConn) handlePipeReq(req *JsonRpcReq) {
 
 	case "pipe.read":
 		pipeid := ei.N(req.Params).M("pipeid").StringZ()
-		if pipeid == "" || !strings.HasPrefix(pipeid, nc.connId) {
+		p := nc.ownedPipe(pipeid)
+		if p == nil {
 			req.Error(ErrInvalidPipe, "", nil)
 			return
 		}
@@ -164,17 +1040,28 @@ func (nc *NexusConn) handlePipeReq(req *JsonRpcReq) {
 		if timeout > 0 {
 			toutCh = time.After(time.Duration(timeout * float64(time.Second)))
 		}
-		messages := make([]interface{}, 0, 10)
+		atomic.AddInt64(&p.Readers, 1)
+		defer atomic.AddInt64(&p.Readers, -1)
+		messages := p.Redeliver(max)
 		tout := false
-		for (len(messages) == 0 || (len(messages) < max && len(ch) > 0)) && !tout {
+		for (len(messages) == 0 || (len(messages) < max && len(ch) > 0 && p.CanDeliver())) && !tout {
+			readCh := ch
+			if !p.CanDeliver() {
+				readCh = nil
+			}
+			var redeliverCh <-chan time.Time
+			if next, ok := p.NextRedelivery(); ok {
+				redeliverCh = time.After(next)
+			}
 			select {
-			case m, ok := <-ch:
+			case m, ok := <-readCh:
 				if !ok {
 					tout = true
 					break
 				}
-				pipe := m.(*Pipe)
-				messages = append(messages, map[string]interface{}{"msg": pipe.Msg, "count": pipe.Count})
+				messages = append(messages, p.Deliver(m.(*Pipe)))
+			case <-redeliverCh:
+				messages = append(messages, p.Redeliver(max-len(messages))...)
 			case <-toutCh:
 				tout = true
 			case <-nc.context.Done():
@@ -182,8 +1069,144 @@ func (nc *NexusConn) handlePipeReq(req *JsonRpcReq) {
 				return
 			}
 		}
+		p.UpdateRead(pipeid)
 		drops, _ := sesNotify.Drops(pipeid, true)
-		req.Result(map[string]interface{}{"msgs": messages, "waiting": len(ch), "drops": drops})
+		result := map[string]interface{}{"msgs": messages, "waiting": len(ch), "drops": drops}
+		if p.AckMode() {
+			result["pending"] = p.PendingLen()
+		}
+		req.Result(result)
+
+	case "pipe.info":
+		pipeid := ei.N(req.Params).M("pipeid").StringZ()
+		p := nc.ownedPipe(pipeid)
+		if p == nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		cur, err := r.Table("pipes").Get(pipeid).Pluck("subs", "creationTime").Run(db)
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		info := ei.M{}
+		err = cur.One(&info)
+		cur.Close()
+		if err != nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		waiting, _ := sesNotify.Waiting(pipeid)
+		drops, _ := sesNotify.Drops(pipeid, false)
+		overflow := p.Overflow
+		if overflow == "" {
+			overflow = OverflowDropNew
+		}
+		result := ei.M{
+			"length":       waiting + p.PendingLen(),
+			"capacity":     p.Capacity,
+			"overflow":     overflow,
+			"waiting":      waiting,
+			"readers":      atomic.LoadInt64(&p.Readers),
+			"drops":        drops,
+			"subs":         ei.N(info).M("subs").SliceZ(),
+			"creationTime": info["creationTime"],
+		}
+		if p.AckMode() {
+			result["pending"] = p.PendingLen()
+		}
+		req.Result(result)
+
+	case "pipe.peek":
+		pipeid := ei.N(req.Params).M("pipeid").StringZ()
+		if nc.ownedPipe(pipeid) == nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		max := ei.N(req.Params).M("max").IntZ()
+		if max <= 0 {
+			max = 10
+		}
+		items, err := sesNotify.Peek(pipeid, max)
+		if err != nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		messages := make([]interface{}, 0, len(items))
+		for _, m := range items {
+			pipe := m.(*Pipe)
+			messages = append(messages, map[string]interface{}{"msg": pipe.Msg, "count": pipe.Count})
+		}
+		waiting, _ := sesNotify.Waiting(pipeid)
+		req.Result(map[string]interface{}{"msgs": messages, "waiting": waiting})
+
+	case "pipe.purge":
+		pipeid := ei.N(req.Params).M("pipeid").StringZ()
+		p := nc.ownedPipe(pipeid)
+		if p == nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		purged, err := sesNotify.Purge(pipeid, ei.N(req.Params).M("n").IntZ())
+		if err != nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		p.UpdateRead(pipeid)
+		waiting, _ := sesNotify.Waiting(pipeid)
+		req.Result(map[string]interface{}{"ok": true, "purged": purged, "waiting": waiting})
+
+	case "pipe.stream":
+		pipeid := ei.N(req.Params).M("pipeid").StringZ()
+		p := nc.ownedPipe(pipeid)
+		if p == nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		credit := ei.N(req.Params).M("credit").Int64Z()
+		if credit <= 0 {
+			credit = 100
+		}
+		total := p.Stream(nc, pipeid, credit)
+		req.Result(map[string]interface{}{"ok": true, "credit": total})
+
+	case "pipe.unstream":
+		pipeid := ei.N(req.Params).M("pipeid").StringZ()
+		p := nc.ownedPipe(pipeid)
+		if p == nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		req.Result(map[string]interface{}{"ok": true, "stopped": p.StopStream()})
+
+	case "pipe.ack":
+		pipeid := ei.N(req.Params).M("pipeid").StringZ()
+		p := nc.ownedPipe(pipeid)
+		if p == nil {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		if !p.AckMode() {
+			req.Error(ErrInvalidParams, "pipe is not in ack mode", nil)
+			return
+		}
+		counts := make([]int64, 0)
+		if count, err := ei.N(req.Params).M("count").Int64(); err == nil {
+			counts = append(counts, count)
+		} else if list, err := ei.N(req.Params).M("count").Slice(); err == nil {
+			for _, c := range list {
+				count, err := ei.N(c).Int64()
+				if err != nil {
+					req.Error(ErrInvalidParams, "count", nil)
+					return
+				}
+				counts = append(counts, count)
+			}
+		} else {
+			req.Error(ErrInvalidParams, "count", nil)
+			return
+		}
+		req.Result(map[string]interface{}{"ok": true, "acked": p.Ack(counts), "pending": p.PendingLen()})
 	default:
 		req.Error(ErrMethodNotFound, "", nil)
 	}
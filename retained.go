@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jaracil/ei"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Store msg and its publisher metadata as the retained message of topic, replacing the previous one
+func topicRetain(topic string, msg interface{}, meta ei.M) error {
+	_, err := r.Table("retained").
+		Insert(ei.M{"id": topic, "msg": r.Literal(msg), "meta": r.Literal(meta), "time": r.Now()}, r.InsertOpts{Conflict: "replace"}).
+		RunWrite(db, r.RunOpts{Durability: "soft"})
+	return err
+}
+
+// Delete the retained messages matching topic, which can be a subscription with wildcards
+func topicUnretain(topic string) (int, error) {
+	ids, err := retainedMatching(topic)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	res, err := r.Table("retained").GetAll(ids...).Delete().RunWrite(db, r.RunOpts{Durability: "soft"})
+	return res.Deleted, err
+}
+
+// Return the retained messages which can match a subscription, from its literal prefix
+func retainedTerm(sub string) r.Term {
+	if sub == topicLiteralPrefix(sub) {
+		return r.Table("retained").GetAll(sub)
+	}
+	base := topicLiteralPrefix(sub)
+	if base == "" {
+		return r.Table("retained")
+	}
+	return r.Table("retained").GetAll(base).Union(r.Table("retained").Between(base+".", base+".\uffff"))
+}
+
+// Return the topics with a retained message matching sub
+func retainedMatching(sub string) ([]interface{}, error) {
+	cur, err := retainedTerm(sub).Field("id").Run(db)
+	if err != nil {
+		return nil, err
+	}
+	topics := make([]string, 0)
+	err = cur.All(&topics)
+	cur.Close()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]interface{}, 0, len(topics))
+	for _, t := range topics {
+		if topicMatch(sub, t) {
+			ids = append(ids, t)
+		}
+	}
+	return ids, nil
+}
+
+// Deliver the retained messages matching sub (and its filter, if any) to a newly subscribed pipe
+func topicSendRetained(ctx context.Context, pipeid string, sub string, filter *TopicFilter) (int, error) {
+	cur, err := retainedTerm(sub).OrderBy("time").Run(db)
+	if err != nil {
+		return 0, err
+	}
+	retained := make([]ei.M, 0)
+	err = cur.All(&retained)
+	cur.Close()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, rm := range retained {
+		topic := ei.N(rm).M("id").StringZ()
+		if !topicMatch(sub, topic) || (filter != nil && !filter.Match(topic, rm["msg"])) {
+			continue
+		}
+		msg := ei.M{"topic": topic, "msg": rm["msg"], "retained": true}
+		for k, v := range ei.N(rm).M("meta").MapStrZ() {
+			msg[k] = v
+		}
+		n, err := topicSendToPipe(ctx, pipeid, msg)
+		if err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jaracil/ei"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Shared pipes are named and owned by a user instead of a session. Their messages
+// are stored on the pipemsgs table so any node can serve them to competing readers.
+
+const _sharedPipePrefix = "@"
+
+func isSharedPipe(pipeid string) bool {
+	return strings.HasPrefix(pipeid, _sharedPipePrefix)
+}
+
+// Store a message on a shared pipe, dropping it if the pipe is full. The message is
+// inserted by the same query counting it on the pipe size.
+func sharedPipeWrite(pipeid string, msg interface{}) (int, error) {
+	cur, err := r.Table("pipes").
+		Get(pipeid).
+		Update(func(p r.Term) interface{} {
+			return r.Branch(p.Field("size").Lt(p.Field("len")),
+				ei.M{"count": p.Field("count").Add(1), "size": p.Field("size").Add(1)},
+				ei.M{"drops": p.Field("drops").Add(1)})
+		}, r.UpdateOpts{ReturnChanges: true}).
+		Do(func(res r.Term) interface{} {
+			change := res.Field("changes").Nth(0)
+			count := change.Field("new_val").Field("count")
+			return r.Branch(res.Field("replaced").Eq(0), false,
+				count.Eq(change.Field("old_val").Field("count")), true,
+				r.Table("pipemsgs").Insert(ei.M{"id": r.Expr(ei.S{pipeid}).Append(count), "msg": msg}).Do(func(r.Term) interface{} {
+					return true
+				}))
+		}).
+		Run(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return ErrInternal, err
+	}
+	var found bool
+	err = cur.One(&found)
+	cur.Close()
+	if err != nil {
+		return ErrInternal, err
+	}
+	if !found {
+		return ErrInvalidPipe, nil
+	}
+	return ErrNoError, nil
+}
+
+// Return the shared pipe if the session is allowed to use it for method
+func (nc *NexusConn) sharedPipe(pipeid string, method string) (ei.M, int) {
+	cur, err := r.Table("pipes").Get(pipeid).Run(db)
+	if err != nil {
+		return nil, ErrInternal
+	}
+	pipe := ei.M{}
+	err = cur.One(&pipe)
+	cur.Close()
+	if err != nil {
+		return nil, ErrInvalidPipe
+	}
+	if ei.N(pipe).M("user").StringZ() == nc.user.User {
+		return pipe, ErrNoError
+	}
+	tags := nc.getTags(strings.TrimPrefix(pipeid, _sharedPipePrefix))
+	if !(ei.N(tags).M("@"+method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+		return nil, ErrPermissionDenied
+	}
+	return pipe, ErrNoError
+}
+
+// Take up to max messages from a shared pipe, oldest first
+func sharedPipeTake(pipeid string, max int, remove bool) ([]interface{}, error) {
+	term := r.Table("pipemsgs").
+		Between(ei.S{pipeid, r.MinVal}, ei.S{pipeid, r.MaxVal}).
+		OrderBy(r.OrderByOpts{Index: "id"}).
+		Limit(max)
+	messages := make([]interface{}, 0)
+	if !remove {
+		cur, err := term.Run(db)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]ei.M, 0)
+		err = cur.All(&items)
+		cur.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			messages = append(messages, ei.M{"msg": item["msg"], "count": ei.N(item).M("id").S(1).Int64Z()})
+		}
+		return messages, nil
+	}
+	// The pipe size is decreased by the same query deleting the messages
+	cur, err := term.
+		Delete(r.DeleteOpts{ReturnChanges: true}).
+		Do(func(res r.Term) interface{} {
+			return r.Branch(res.Field("deleted").Eq(0), res,
+				r.Table("pipes").
+					Get(pipeid).
+					Update(func(p r.Term) interface{} {
+						return ei.M{"size": p.Field("size").Sub(res.Field("deleted"))}
+					}).
+					Do(func(r.Term) interface{} {
+						return res
+					}))
+		}).
+		Run(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return nil, err
+	}
+	res := r.WriteResponse{}
+	err = cur.One(&res)
+	cur.Close()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]ei.M, 0, len(res.Changes))
+	for _, change := range res.Changes {
+		item := ei.N(change.OldValue)
+		items = append(items, ei.M{"msg": item.M("msg").RawZ(), "count": item.M("id").S(1).Int64Z()})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i]["count"].(int64) < items[j]["count"].(int64) })
+	for _, item := range items {
+		messages = append(messages, item)
+	}
+	return messages, nil
+}
+
+func (nc *NexusConn) handleSharedPipeReq(req *JsonRpcReq) {
+	pipeid := ei.N(req.Params).M("pipeid").StringZ()
+	switch req.Method {
+	case "pipe.create":
+		name, err := ei.N(req.Params).M("shared").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "shared", nil)
+			return
+		}
+		tags := nc.getTags(name)
+		if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		length := ei.N(req.Params).M("len").IntZ()
+		if length <= 0 {
+			length = opts.Rethink.DefPipeLen
+		}
+		if length > opts.Rethink.MaxPipeLen {
+			length = opts.Rethink.MaxPipeLen
+		}
+		pipeid = _sharedPipePrefix + name
+		res, err := r.Table("pipes").
+			Insert(ei.M{
+				"id":           pipeid,
+				"user":         nc.user.User,
+				"shared":       true,
+				"owners":       ei.S{nc.connId},
+				"len":          length,
+				"count":        0,
+				"size":         0,
+				"drops":        0,
+				"creationTime": r.Now(),
+			}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil && res.Errors == 0 {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		// Creating an existing shared pipe opens it for its owner
+		if res.Inserted <= 0 {
+			if !nc.ownsSharedPipe(pipeid) {
+				req.Error(ErrPermissionDenied, "pipe is owned by another user", nil)
+				return
+			}
+			_, err = r.Table("pipes").
+				Get(pipeid).
+				Update(ei.M{"owners": r.Row.Field("owners").Default(ei.S{}).SetInsert(nc.connId)}).
+				RunWrite(db, r.RunOpts{Durability: "hard"})
+			if err != nil {
+				req.Error(ErrInternal, "", nil)
+				return
+			}
+		}
+		req.Result(ei.M{"pipeid": pipeid})
+
+	case "pipe.close":
+		pipe, code := nc.sharedPipe(pipeid, req.Method)
+		if code != ErrNoError {
+			req.Error(code, "", nil)
+			return
+		}
+		if ei.N(pipe).M("user").StringZ() != nc.user.User && !ei.N(nc.getTags(strings.TrimPrefix(pipeid, _sharedPipePrefix))).M("@admin").BoolZ() {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		// The pipe is only deleted when no other session of its owner keeps it open
+		res, err := r.Table("pipes").
+			Get(pipeid).
+			Replace(func(p r.Term) interface{} {
+				owners := p.Field("owners").Default(ei.S{}).Difference(ei.S{nc.connId})
+				return r.Branch(p.Eq(nil).Or(owners.IsEmpty()), nil, p.Merge(ei.M{"owners": owners}))
+			}).
+			RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		if res.Deleted > 0 {
+			r.Table("pipemsgs").
+				Between(ei.S{pipeid, r.MinVal}, ei.S{pipeid, r.MaxVal}).
+				Delete().
+				RunWrite(db, r.RunOpts{Durability: "soft"})
+		} else if res.Replaced == 0 && res.Unchanged == 0 {
+			req.Error(ErrInvalidPipe, "", nil)
+			return
+		}
+		req.Result(ei.M{"ok": true, "closed": res.Deleted > 0})
+
+	case "pipe.read":
+		if _, code := nc.sharedPipe(pipeid, req.Method); code != ErrNoError {
+			req.Error(code, "", nil)
+			return
+		}
+		max := ei.N(req.Params).M("max").IntZ()
+		if max <= 0 {
+			max = 10
+		}
+		var toutCh <-chan time.Time
+		timeout := ei.N(req.Params).M("timeout").Float64Z()
+		if timeout > 0 {
+			toutCh = time.After(time.Duration(timeout * float64(time.Second)))
+		}
+		next, done := pipeWaiters.Wait(pipeid)
+		defer done()
+		messages := make([]interface{}, 0)
+		tout := false
+		for len(messages) == 0 && !tout {
+			wake := next()
+			var err error
+			messages, err = sharedPipeTake(pipeid, max, true)
+			if err != nil {
+				req.Error(ErrInternal, "", nil)
+				return
+			}
+			if len(messages) > 0 {
+				break
+			}
+			select {
+			case <-wake:
+			case <-toutCh:
+				tout = true
+			case <-nc.context.Done():
+				req.Error(ErrCancel, "", nil)
+				return
+			}
+		}
+		pipe, code := nc.sharedPipe(pipeid, req.Method)
+		if code != ErrNoError {
+			req.Error(code, "", nil)
+			return
+		}
+		req.Result(ei.M{"msgs": messages, "waiting": ei.N(pipe).M("size").IntZ(), "drops": ei.N(pipe).M("drops").IntZ()})
+
+	case "pipe.peek":
+		pipe, code := nc.sharedPipe(pipeid, "pipe.read")
+		if code != ErrNoError {
+			req.Error(code, "", nil)
+			return
+		}
+		max := ei.N(req.Params).M("max").IntZ()
+		if max <= 0 {
+			max = 10
+		}
+		messages, err := sharedPipeTake(pipeid, max, false)
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		req.Result(ei.M{"msgs": messages, "waiting": ei.N(pipe).M("size").IntZ()})
+
+	case "pipe.purge":
+		if _, code := nc.sharedPipe(pipeid, "pipe.read"); code != ErrNoError {
+			req.Error(code, "", nil)
+			return
+		}
+		n := ei.N(req.Params).M("n").IntZ()
+		if n <= 0 {
+			n = opts.Rethink.MaxPipeLen
+		}
+		messages, err := sharedPipeTake(pipeid, n, true)
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		pipe, _ := nc.sharedPipe(pipeid, "pipe.read")
+		req.Result(ei.M{"ok": true, "purged": len(messages), "waiting": ei.N(pipe).M("size").IntZ()})
+
+	case "pipe.info":
+		pipe, code := nc.sharedPipe(pipeid, "pipe.read")
+		if code != ErrNoError {
+			req.Error(code, "", nil)
+			return
+		}
+		req.Result(ei.M{
+			"length":       ei.N(pipe).M("size").IntZ(),
+			"waiting":      ei.N(pipe).M("size").IntZ(),
+			"capacity":     ei.N(pipe).M("len").IntZ(),
+			"overflow":     OverflowDropNew,
+			"drops":        ei.N(pipe).M("drops").IntZ(),
+			"subs":         ei.S{},
+			"creationTime": pipe["creationTime"],
+			"user":         ei.N(pipe).M("user").StringZ(),
+		})
+
+	default:
+		req.Error(ErrInvalidParams, "method not supported on shared pipes", nil)
+	}
+}
+
+func (nc *NexusConn) ownsSharedPipe(pipeid string) bool {
+	cur, err := r.Table("pipes").Get(pipeid).Field("user").Default("").Run(db)
+	if err != nil {
+		return false
+	}
+	var user string
+	cur.One(&user)
+	cur.Close()
+	return user != "" && user == nc.user.User
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaracil/ei"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Retention of the messages of each durable topic stream. Zero keeps them forever
+var topicStreams = map[string]time.Duration{}
+
+// Parse the --topicstream options (prefix[:retention])
+func loadTopicStreams() error {
+	for _, v := range opts.TopicStream {
+		chunks := strings.Split(v, ":")
+		if len(chunks) > 2 {
+			return fmt.Errorf("invalid topic stream %q", v)
+		}
+		prefix := strings.Trim(strings.ToLower(chunks[0]), ". ")
+		if prefix == "" {
+			return fmt.Errorf("invalid topic stream prefix on %q", v)
+		}
+		var retention time.Duration
+		if len(chunks) == 2 {
+			secs, err := strconv.ParseFloat(chunks[1], 64)
+			if err != nil || secs < 0 {
+				return fmt.Errorf("invalid topic stream retention on %q", v)
+			}
+			retention = time.Duration(secs * float64(time.Second))
+		}
+		topicStreams[prefix] = retention
+	}
+	return nil
+}
+
+// Return the most specific durable stream holding topic or an empty string if there is none
+func topicStream(topic string) string {
+	if len(topicStreams) == 0 {
+		return ""
+	}
+	for _, p := range prefixes(topic) {
+		if _, ok := topicStreams[p]; ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// Append a message and its publisher metadata to a durable stream, returning its offset. The message
+// is stored by the same query taking its offset, so it's there for replays reading up to it.
+func streamAppend(stream string, topic string, msg interface{}, meta ei.M) (int64, error) {
+	cur, err := r.Table("streams").
+		Get(stream).
+		Replace(func(s r.Term) interface{} {
+			return r.Branch(s.Eq(nil), ei.M{"id": stream, "offset": 1}, s.Merge(ei.M{"offset": s.Field("offset").Add(1)}))
+		}, r.ReplaceOpts{ReturnChanges: true}).
+		Do(func(res r.Term) interface{} {
+			offset := res.Field("changes").Nth(0).Field("new_val").Field("offset")
+			return r.Table("streammsgs").
+				Insert(ei.M{"id": r.Expr(ei.S{stream, offset}), "topic": topic, "msg": r.Literal(msg), "meta": r.Literal(meta), "time": r.Now()}).
+				Do(func(r.Term) interface{} {
+					return offset
+				})
+		}).
+		Run(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return 0, err
+	}
+	var offset int64
+	err = cur.One(&offset)
+	cur.Close()
+	return offset, err
+}
+
+// Write on a pipe the stream messages matching sub and its filter, from an offset (or a time) up to another offset.
+// The stream is read in pages of MaxPipeLen messages.
+func streamReplay(ctx context.Context, pipeid string, stream string, sub string, filter *TopicFilter, from int64, since *time.Time, upto int64) (int, error) {
+	if since != nil {
+		cur, err := r.Table("streammsgs").
+			Between(ei.S{stream, *since}, ei.S{stream, r.MaxVal}, r.BetweenOpts{Index: "stime"}).
+			OrderBy(r.OrderByOpts{Index: "stime"}).
+			Limit(1).
+			Map(func(sm r.Term) interface{} {
+				return sm.Field("id").Nth(1)
+			}).
+			Run(db)
+		if err != nil {
+			return 0, err
+		}
+		first := make([]int64, 0)
+		err = cur.All(&first)
+		cur.Close()
+		if err != nil {
+			return 0, err
+		}
+		if len(first) == 0 {
+			return 0, nil
+		}
+		from = first[0]
+	}
+	sent := 0
+	for from <= upto {
+		// Messages of other topics only return their id, to page through them
+		cur, err := r.Table("streammsgs").
+			Between(ei.S{stream, from}, ei.S{stream, upto}, r.BetweenOpts{RightBound: "closed"}).
+			OrderBy(r.OrderByOpts{Index: "id"}).
+			Limit(opts.Rethink.MaxPipeLen).
+			Map(func(sm r.Term) interface{} {
+				return r.Branch(sm.Field("topic").Match(topicRegexp(sub)), sm, ei.M{"id": sm.Field("id")})
+			}).
+			Run(db)
+		if err != nil {
+			return sent, err
+		}
+		read := 0
+		sm := ei.M{}
+		for cur.Next(&sm) {
+			read++
+			offset := ei.N(sm).M("id").S(1).Int64Z()
+			from = offset + 1
+			topic, err := ei.N(sm).M("topic").String()
+			if err != nil || (filter != nil && !filter.Match(topic, sm["msg"])) {
+				sm = ei.M{}
+				continue
+			}
+			msg := ei.M{"topic": topic, "msg": sm["msg"], "offset": offset, "replayed": true}
+			for k, v := range ei.N(sm).M("meta").MapStrZ() {
+				msg[k] = v
+			}
+			n, err := topicSendToPipe(ctx, pipeid, msg)
+			if err != nil {
+				cur.Close()
+				return sent, err
+			}
+			sent += n
+			sm = ei.M{}
+		}
+		err = cur.Err()
+		cur.Close()
+		if err != nil {
+			return sent, err
+		}
+		if read < opts.Rethink.MaxPipeLen {
+			break
+		}
+	}
+	return sent, nil
+}
+
+// Delete the stream messages older than their stream retention
+func streamPurge() {
+	defer exit("stream purge goroutine error")
+	tick := time.NewTicker(time.Second * 10)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if isMasterNode() {
+				for stream, retention := range topicStreams {
+					if retention <= 0 {
+						continue
+					}
+					r.Table("streammsgs").
+						Between(ei.S{stream, r.MinVal}, ei.S{stream, r.Now().Sub(retention.Seconds())}, r.BetweenOpts{Index: "stime"}).
+						Delete().
+						RunWrite(db, r.RunOpts{Durability: "soft"})
+				}
+			}
+		case <-mainContext.Done():
+			return
+		}
+	}
+}
@@ -1,10 +1,76 @@
 package main
 
 import (
+	"time"
+
 	"github.com/jaracil/ei"
 	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
 )
 
+// Lock modes. Exclusive locks have a single owner, shared locks and semaphores are held
+// by the sessions on their owners field until the last one frees it.
+const (
+	LockExclusive = "exclusive"
+	LockShared    = "shared"
+	LockSemaphore = "semaphore"
+)
+
+// Shared locks and semaphores keep the lease of each owner on their leases field, by connid.
+// Their expires field is the earliest of them, so lockPurge finds the row when any lease expires.
+func lockLeases(l r.Term, leases r.Term) r.Term {
+	l = l.Without("leases", "expires")
+	return r.Branch(leases.Keys().IsEmpty(), l,
+		l.Merge(ei.M{
+			"leases": leases,
+			"expires": leases.Values().Map(func(lease r.Term) interface{} {
+				return lease.Field("expires")
+			}).Min(),
+		}))
+}
+
+// Return whether the lock row l is held by the session
+func lockHeldBy(l interface{}, connId string) bool {
+	if ei.N(l).M("owner").StringZ() == connId {
+		return true
+	}
+	for _, owner := range ei.N(l).M("owners").SliceZ() {
+		if owner == connId {
+			return true
+		}
+	}
+	return false
+}
+
+// Free the locks whose lease expired. Shared locks and semaphores only lose the owners whose lease expired.
+func lockPurge() {
+	defer exit("lock purge goroutine error")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if isMasterNode() {
+				r.Table("locks").
+					Between(r.MinVal, r.Now(), r.BetweenOpts{Index: "expires"}).
+					Replace(func(l r.Term) interface{} {
+						leases := l.Field("leases").Default(ei.M{})
+						expired := leases.Keys().Filter(func(owner r.Term) interface{} {
+							return leases.Field(owner).Field("expires").Le(r.Now())
+						})
+						owners := l.Field("owners").Default(ei.S{}).SetDifference(expired)
+						return r.Branch(l.HasFields("owners"),
+							r.Branch(owners.IsEmpty(), nil, lockLeases(l.Merge(ei.M{"owners": owners}), leases.Without(expired))),
+							l.Field("expires").Le(r.Now()), nil,
+							l)
+					}).
+					RunWrite(db, r.RunOpts{Durability: "soft"})
+			}
+		case <-mainContext.Done():
+			return
+		}
+	}
+}
+
 func (nc *NexusConn) handleSyncReq(req *JsonRpcReq) {
 	switch req.Method {
 	case "sync.lock":
@@ -18,23 +84,106 @@ func (nc *NexusConn) handleSyncReq(req *JsonRpcReq) {
 			req.Error(ErrPermissionDenied, "", nil)
 			return
 		}
+		row := ei.M{"id": lock, "owner": nc.connId}
+		switch mode := ei.N(req.Params).M("mode").StringZ(); mode {
+		case "", LockExclusive:
+		case LockShared:
+			row = ei.M{"id": lock, "mode": LockShared, "owners": ei.S{nc.connId}}
+		default:
+			req.Error(ErrInvalidParams, "mode", nil)
+			return
+		}
+		nc.syncAcquire(req, row)
+
+	case "sync.unlock":
+		lock, err := ei.N(req.Params).M("lock").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "lock", nil)
+			return
+		}
+		tags := nc.getTags(lock)
+		if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		nc.syncRelease(req, lock)
+
+	case "sync.semAcquire":
+		sem, err := ei.N(req.Params).M("sem").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "sem", nil)
+			return
+		}
+		capacity, err := ei.N(req.Params).M("capacity").Int()
+		if err != nil || capacity <= 0 {
+			req.Error(ErrInvalidParams, "capacity", nil)
+			return
+		}
+		tags := nc.getTags(sem)
+		if !(ei.N(tags).M("@sync.lock").BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		nc.syncAcquire(req, ei.M{"id": sem, "mode": LockSemaphore, "capacity": capacity, "owners": ei.S{nc.connId}})
+
+	case "sync.semRelease":
+		sem, err := ei.N(req.Params).M("sem").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "sem", nil)
+			return
+		}
+		tags := nc.getTags(sem)
+		if !(ei.N(tags).M("@sync.unlock").BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		nc.syncRelease(req, sem)
+
+	case "sync.refresh":
+		lock, err := ei.N(req.Params).M("lock").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "lock", nil)
+			return
+		}
+		tags := nc.getTags(lock)
+		if !(ei.N(tags).M("@sync.lock").BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		t := ei.N(req.Params).M("ttl").Float64Z()
 		res, err := r.Table("locks").
-			Insert(ei.M{"id": lock, "owner": nc.connId}).
+			Get(lock).
+			Replace(func(l r.Term) interface{} {
+				ttl, lease := r.Expr(t), l.Field("leases").Default(ei.M{}).Field(nc.connId).Default(ei.M{})
+				if t <= 0 {
+					ttl = lease.Field("ttl").Default(l.Field("ttl").Default(0))
+				}
+				return r.Branch(l.Eq(nil).Or(ttl.Le(0)), l,
+					l.Field("owner").Default("").Eq(nc.connId), l.Merge(ei.M{"ttl": ttl, "expires": r.Now().Add(ttl)}),
+					l.Field("owners").Default(ei.S{}).Contains(nc.connId), lockLeases(l, l.Field("leases").Merge(r.Object(nc.connId, ei.M{"ttl": ttl, "expires": r.Now().Add(ttl)}))),
+					l)
+			}, r.ReplaceOpts{ReturnChanges: "always"}).
 			RunWrite(db, r.RunOpts{Durability: "hard"})
 		if err != nil {
-			if r.IsConflictErr(err) {
-				req.Error(ErrLockNotOwned, "", nil)
-			} else {
-				req.Error(ErrInternal, "", nil)
-			}
+			req.Error(ErrInternal, "", nil)
 			return
 		}
-		if res.Inserted <= 0 {
+		if res.Replaced <= 0 {
+			// Holders of a lock grabbed without ttl must pass one to refresh it
+			if len(res.Changes) > 0 && lockHeldBy(res.Changes[0].OldValue, nc.connId) {
+				req.Error(ErrInvalidParams, "ttl", nil)
+				return
+			}
 			req.Error(ErrLockNotOwned, "", nil)
 			return
 		}
-		req.Result(ei.M{"ok": true})
-	case "sync.unlock":
+		expires := ei.N(res.Changes[0].NewValue).M("leases").M(nc.connId).M("expires").RawZ()
+		if expires == nil {
+			expires = ei.N(res.Changes[0].NewValue).M("expires").RawZ()
+		}
+		req.Result(ei.M{"ok": true, "expires": expires})
+
+	case "sync.info":
 		lock, err := ei.N(req.Params).M("lock").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
 		if err != nil {
 			req.Error(ErrInvalidParams, "lock", nil)
@@ -45,21 +194,38 @@ func (nc *NexusConn) handleSyncReq(req *JsonRpcReq) {
 			req.Error(ErrPermissionDenied, "", nil)
 			return
 		}
-		res, err := r.Table("locks").
-			GetAll(lock).
-			Filter(r.Row.Field("owner").Eq(nc.connId)).
-			Delete().
-			RunWrite(db, r.RunOpts{Durability: "hard"})
-
+		held := r.Table("locks").Get(lock)
+		cur, err := r.Expr(ei.M{
+			"lock":  r.Branch(held.Eq(nil), nil, held.Pluck("owner", "mode", "owners", "capacity", "expires")),
+			"token": held.Field("token").Default(r.Table("fences").Get(lock).Field("token").Default(0)),
+		}).Run(db)
 		if err != nil {
 			req.Error(ErrInternal, err.Error(), nil)
 			return
 		}
-		if res.Deleted <= 0 {
-			req.Error(ErrLockNotOwned, "", nil)
+		defer cur.Close()
+		info := ei.M{}
+		if err := cur.One(&info); err != nil {
+			req.Error(ErrInternal, "", nil)
 			return
 		}
-		req.Result(ei.M{"ok": true})
+		res := ei.M{"id": lock, "locked": false, "token": info["token"]}
+		if held, ok := info["lock"].(map[string]interface{}); ok {
+			for k, v := range held {
+				res[k] = v
+			}
+			res["locked"] = true
+		}
+		req.Result(res)
+
+	case "sync.elect", "sync.resign", "sync.leader":
+		nc.handleElectionReq(req)
+
+	case "sync.barrier", "sync.latch", "sync.countDown", "sync.await":
+		nc.handleBarrierReq(req)
+
+	case "sync.watch", "sync.unwatch":
+		nc.handleWatchReq(req, WatchLocks, "sync.list", req.Method == "sync.watch")
 
 	case "sync.list":
 		prefix, depth, filter, limit, skip := getListParams(req.Params)
@@ -71,7 +237,7 @@ func (nc *NexusConn) handleSyncReq(req *JsonRpcReq) {
 		}
 
 		term := getListTerm("locks", "", "id", prefix, depth, filter, limit, skip).
-			Pluck("id", "owner")
+			Pluck("id", "owner", "mode", "owners", "capacity", "expires")
 
 		cur, err := term.Run(db)
 		defer cur.Close()
@@ -121,3 +287,80 @@ func (nc *NexusConn) handleSyncReq(req *JsonRpcReq) {
 		req.Error(ErrMethodNotFound, "", nil)
 	}
 }
+
+// Grab the lock row, queuing up for it when the request has a wait timeout
+func (nc *NexusConn) syncAcquire(req *JsonRpcReq, row ei.M) {
+	if ttl := ei.N(req.Params).M("ttl").Float64Z(); ttl > 0 {
+		if _, ok := row["owners"]; ok {
+			row["leases"] = r.Object(nc.connId, ei.M{"ttl": ttl, "expires": r.Now().Add(ttl)})
+		} else {
+			row["ttl"] = ttl
+		}
+		row["expires"] = r.Now().Add(ttl)
+	}
+	token, err := lockAcquire(row, "")
+	if err == nil && token == 0 && ei.N(row).M("mode").StringZ() == LockSemaphore {
+		if held, err := semCapacity(ei.N(row).M("id").StringZ()); err == nil && held > 0 && held != ei.N(row).M("capacity").IntZ() {
+			req.Error(ErrInvalidParams, "capacity", ei.M{"capacity": held})
+			return
+		}
+	}
+	wait := ei.N(req.Params).M("wait").Float64Z()
+	if err == nil && token == 0 && wait > 0 {
+		token, err = nc.lockWait(row, wait)
+	}
+	if err != nil {
+		req.Error(ErrInternal, "", nil)
+		return
+	}
+	if token == 0 {
+		if wait > 0 {
+			req.Error(ErrTimeout, "", nil)
+		} else {
+			req.Error(ErrLockNotOwned, "", nil)
+		}
+		return
+	}
+	req.Result(ei.M{"ok": true, "token": token})
+}
+
+// Return the capacity a semaphore is held with, or 0 if it's not held as a semaphore
+func semCapacity(sem string) (int, error) {
+	cur, err := r.Table("locks").
+		Get(sem).
+		Do(func(l r.Term) interface{} {
+			return r.Branch(l.Field("mode").Default("").Eq(LockSemaphore), l.Field("capacity"), 0)
+		}).
+		Run(db)
+	if err != nil {
+		return 0, err
+	}
+	var capacity int
+	err = cur.One(&capacity)
+	cur.Close()
+	return capacity, err
+}
+
+// Leave the lock row, deleting it when the session was its last holder
+func (nc *NexusConn) syncRelease(req *JsonRpcReq, lock string) {
+	res, err := r.Table("locks").
+		Get(lock).
+		Replace(func(l r.Term) interface{} {
+			owners := l.Field("owners").Default(ei.S{}).SetDifference(ei.S{nc.connId})
+			leases := l.Field("leases").Default(ei.M{}).Without(nc.connId)
+			return r.Branch(l.Eq(nil), nil,
+				l.Field("owner").Default("").Eq(nc.connId), nil,
+				l.Field("owners").Default(ei.S{}).Contains(nc.connId), r.Branch(owners.IsEmpty(), nil, lockLeases(l.Merge(ei.M{"owners": owners}), leases)),
+				l)
+		}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	if err != nil {
+		req.Error(ErrInternal, err.Error(), nil)
+		return
+	}
+	if res.Deleted+res.Replaced <= 0 {
+		req.Error(ErrLockNotOwned, "", nil)
+		return
+	}
+	req.Result(ei.M{"ok": true})
+}
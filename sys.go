@@ -306,17 +306,36 @@ func (nc *NexusConn) BasicAuth(params interface{}) (string, map[string]map[strin
 		return "", nil, ErrInvalidParams
 	}
 
+	attempt, err := loginReserve(user, remoteHost(nc.remote))
+	if err != nil {
+		return "", nil, ErrInternal
+	}
+	if attempt == nil {
+		return "", nil, ErrLockedOut
+	}
+
 	ud, rerr := loadUserData(user)
 	if rerr != ErrNoError {
+		if rerr == ErrPermissionDenied {
+			nc.loginFailed(attempt)
+		} else {
+			nc.loginAborted(attempt)
+		}
 		return "", nil, rerr
 	}
-	dk, err := HashPass(pass, ud.Salt)
+	ok, rehash, err := VerifyPass(pass, ud)
 	if err != nil {
+		nc.loginAborted(attempt)
 		return "", nil, ErrInternal
 	}
-	if ud.Pass != dk {
+	if !ok {
+		nc.loginFailed(attempt)
 		return "", nil, ErrPermissionDenied
 	}
+	nc.loginSucceeded(attempt)
+	if rehash {
+		rehashPass(ud, pass)
+	}
 
 	if suser != "" {
 		tags := getTags(ud, suser)
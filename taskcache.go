@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TaskCachePolicy struct {
+	Ttl        time.Duration
+	MaxEntries int
+}
+
+type TaskCache struct {
+	sync.Mutex
+	Policies map[string]*TaskCachePolicy
+	Map      map[string]map[string]*TaskCacheItem
+}
+
+type TaskCacheItem struct {
+	Result interface{}
+	Expire time.Time
+}
+
+var taskCache = &TaskCache{
+	Policies: map[string]*TaskCachePolicy{},
+	Map:      map[string]map[string]*TaskCacheItem{},
+}
+
+const _taskCacheDefMaxEntries = 1000
+
+// Parse the --taskcache options (path:ttl[:maxentries])
+func loadTaskCachePolicies() error {
+	for _, v := range opts.TaskCache {
+		chunks := strings.Split(v, ":")
+		if len(chunks) < 2 || len(chunks) > 3 {
+			return fmt.Errorf("invalid task cache policy %q", v)
+		}
+		path := strings.Trim(strings.ToLower(chunks[0]), ". ")
+		if path == "" {
+			return fmt.Errorf("invalid task cache path on %q", v)
+		}
+		ttl, err := strconv.ParseFloat(chunks[1], 64)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid task cache ttl on %q", v)
+		}
+		max := _taskCacheDefMaxEntries
+		if len(chunks) == 3 {
+			max, err = strconv.Atoi(chunks[2])
+			if err != nil || max <= 0 {
+				return fmt.Errorf("invalid task cache max entries on %q", v)
+			}
+		}
+		taskCache.Policies[path] = &TaskCachePolicy{
+			Ttl:        time.Duration(ttl * float64(time.Second)),
+			MaxEntries: max,
+		}
+	}
+	return nil
+}
+
+// Return the most specific path with a cache policy for method
+func taskCachePath(method string) string {
+	if len(taskCache.Policies) == 0 {
+		return ""
+	}
+	for _, p := range prefixes(method) {
+		if _, ok := taskCache.Policies[p]; ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// Return the cache key of a task or an empty string if its method is not cacheable
+func taskCacheKey(method string, params interface{}) string {
+	if taskCachePath(method) == "" {
+		return ""
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	return method + "|" + string(b)
+}
+
+func (c *TaskCache) Get(method string, key string) (interface{}, bool) {
+	path := taskCachePath(method)
+	if path == "" {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if item, ok := c.Map[path][key]; ok {
+		if time.Now().Before(item.Expire) {
+			return item.Result, true
+		}
+		delete(c.Map[path], key)
+	}
+	return nil, false
+}
+
+func (c *TaskCache) Set(method string, key string, result interface{}) {
+	path := taskCachePath(method)
+	if path == "" {
+		return
+	}
+	policy := c.Policies[path]
+	c.Lock()
+	defer c.Unlock()
+	items, ok := c.Map[path]
+	if !ok {
+		items = map[string]*TaskCacheItem{}
+		c.Map[path] = items
+	}
+	if _, ok := items[key]; !ok && len(items) >= policy.MaxEntries {
+		c.evict(items, policy.MaxEntries)
+	}
+	items[key] = &TaskCacheItem{result, time.Now().Add(policy.Ttl)}
+}
+
+// Make room for one item removing the expired ones or, if there are none, the oldest one
+func (c *TaskCache) evict(items map[string]*TaskCacheItem, max int) {
+	now := time.Now()
+	oldestKey := ""
+	var oldest time.Time
+	for k, item := range items {
+		if item.Expire.Before(now) {
+			delete(items, k)
+			continue
+		}
+		if oldestKey == "" || item.Expire.Before(oldest) {
+			oldestKey, oldest = k, item.Expire
+		}
+	}
+	if len(items) >= max && oldestKey != "" {
+		delete(items, oldestKey)
+	}
+}
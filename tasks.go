@@ -31,6 +31,7 @@ type Task struct {
 	CreationTime interface{} `gorethink:"creationTime,omitempty" json:"creationTime"`
 	WorkingTime  interface{} `gorethink:"workingTime,omitempty" json:"workingTime"`
 	DeadLine     interface{} `gorethink:"deadLine,omitempty" json:"deadline"`
+	CacheKey     string      `gorethink:"cacheKey,omitempty" json:"-"`
 }
 
 type TaskFeed struct {
@@ -101,7 +102,8 @@ func taskTrack() {
 				"errObj",
 				"tses",
 				"creationTime",
-				"workingTime"}}).
+				"workingTime",
+				"cacheKey"}}).
 			Run(db)
 		if err != nil {
 			Log.WithFields(logrus.Fields{
@@ -127,6 +129,9 @@ func taskTrack() {
 				if !task.Detach {
 					sesNotify.Notify(task.Id[0:16], task)
 				}
+				if task.CacheKey != "" && task.ErrCode == nil {
+					taskCache.Set(task.Path+task.Method, task.CacheKey, task.Result)
+				}
 				go deleteTask(task.Id)
 			case "working":
 				if strings.HasPrefix(task.Path, "@pull.") {
@@ -309,6 +314,25 @@ func (nc *NexusConn) handleTaskReq(req *JsonRpcReq) {
 			return
 		}
 		path, met := getPathMethod(method)
+		var cacheKey string
+		if !detach {
+			cacheKey = taskCacheKey(method, params)
+		}
+		if cacheKey != "" {
+			if result, ok := taskCache.Get(method, cacheKey); ok {
+				hook("task", path+met, nc.user.User, ei.M{
+					"action":    "cached",
+					"connid":    nc.connId,
+					"user":      nc.user.User,
+					"path":      path,
+					"method":    met,
+					"params":    params,
+					"timestamp": time.Now().UTC(),
+				})
+				req.Result(result)
+				return
+			}
+		}
 		timeout := ei.N(req.Params).M("timeout").Float64Z()
 		if timeout <= 0 {
 			timeout = 60 * 60 * 24 * 10 // Ten days
@@ -327,6 +351,7 @@ func (nc *NexusConn) handleTaskReq(req *JsonRpcReq) {
 			LocalId:      req.Id,
 			CreationTime: r.Now(),
 			DeadLine:     r.Now().Add(timeout),
+			CacheKey:     cacheKey,
 		}
 		nc.log.WithFields(logrus.Fields{
 			"connid": req.nc.connId,
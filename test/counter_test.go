@@ -0,0 +1,74 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxgo/nxcore"
+)
+
+func TestCounterIncrReset(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	counter := Prefix3 + ".counter.seq"
+	conn.Exec("counter.reset", map[string]interface{}{"counter": counter})
+	for i := 1; i <= 3; i++ {
+		res, err := conn.Exec("counter.incr", map[string]interface{}{"counter": counter})
+		if err != nil {
+			t.Fatalf("counter.incr: %s", err.Error())
+		}
+		if ei.N(res).M("value").IntZ() != i {
+			t.Errorf("counter.incr: expecting %d, got %v", i, res)
+		}
+	}
+	res, err := conn.Exec("counter.incr", map[string]interface{}{"counter": counter, "by": 10})
+	if err != nil || ei.N(res).M("value").IntZ() != 13 {
+		t.Errorf("counter.incr by 10: expecting 13, got %v %v", res, err)
+	}
+	res, err = conn.Exec("counter.get", map[string]interface{}{"counter": counter})
+	if err != nil || ei.N(res).M("value").IntZ() != 13 {
+		t.Errorf("counter.get: expecting 13, got %v %v", res, err)
+	}
+	if _, err = conn.Exec("counter.incr", map[string]interface{}{"counter": counter, "by": 0.5}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("counter.incr by a fraction: expecting ErrInvalidParams")
+	}
+	if _, err = conn.Exec("counter.incr", map[string]interface{}{"counter": counter, "by": 1<<53 - 1}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("counter.incr out of range: expecting ErrInvalidParams")
+	}
+	res, err = conn.Exec("counter.reset", map[string]interface{}{"counter": counter})
+	if err != nil || !ei.N(res).M("reset").BoolZ() {
+		t.Errorf("counter.reset: unexpected result %v %v", res, err)
+	}
+	res, err = conn.Exec("counter.get", map[string]interface{}{"counter": counter})
+	if err != nil || ei.N(res).M("value").IntZ() != 0 {
+		t.Errorf("counter.get after reset: expecting 0, got %v %v", res, err)
+	}
+}
+
+func TestCounterWindow(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	counter := Prefix3 + ".counter.rate"
+	conn.Exec("counter.reset", map[string]interface{}{"counter": counter})
+	for i := 1; i <= 2; i++ {
+		res, err := conn.Exec("counter.incr", map[string]interface{}{"counter": counter, "window": 1})
+		if err != nil || ei.N(res).M("value").IntZ() != i {
+			t.Errorf("counter.incr with window: expecting %d, got %v %v", i, res, err)
+		}
+	}
+	time.Sleep(time.Millisecond * 1500)
+	res, err := conn.Exec("counter.incr", map[string]interface{}{"counter": counter, "window": 1})
+	if err != nil || ei.N(res).M("value").IntZ() != 1 {
+		t.Errorf("counter.incr on a new window: expecting 1, got %v %v", res, err)
+	}
+	conn.Exec("counter.reset", map[string]interface{}{"counter": counter})
+}
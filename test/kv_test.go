@@ -0,0 +1,222 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaracil/ei"
+)
+
+func TestKvSetGetDelete(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	key := Prefix3 + ".kv.toggles" + Suffix
+	res, err := conn.Exec("kv.get", map[string]interface{}{"key": key})
+	if err != nil {
+		t.Fatalf("kv.get: %s", err.Error())
+	}
+	if ei.N(res).M("version").IntZ() != 0 || ei.N(res).M("value").RawZ() != nil {
+		t.Errorf("kv.get missing key: unexpected result %v", res)
+	}
+
+	for i := 1; i <= 2; i++ {
+		res, err = conn.Exec("kv.set", map[string]interface{}{"key": key, "value": map[string]interface{}{"beta": i}})
+		if err != nil {
+			t.Fatalf("kv.set: %s", err.Error())
+		}
+		if ei.N(res).M("version").IntZ() != i {
+			t.Errorf("kv.set: expecting version %d, got %v", i, res)
+		}
+	}
+	res, err = conn.Exec("kv.get", map[string]interface{}{"key": key})
+	if err != nil {
+		t.Fatalf("kv.get: %s", err.Error())
+	}
+	if ei.N(res).M("value").M("beta").IntZ() != 2 || ei.N(res).M("version").IntZ() != 2 {
+		t.Errorf("kv.get: unexpected result %v", res)
+	}
+
+	res, err = conn.Exec("kv.list", map[string]interface{}{"prefix": Prefix3 + ".kv"})
+	if err != nil {
+		t.Errorf("kv.list: %s", err.Error())
+	} else if len(ei.N(res).SliceZ()) != 1 || ei.N(res).S(0).M("key").StringZ() != key {
+		t.Errorf("kv.list: unexpected result %v", res)
+	}
+
+	res, err = conn.Exec("kv.delete", map[string]interface{}{"key": key})
+	if err != nil || !ei.N(res).M("deleted").BoolZ() {
+		t.Errorf("kv.delete: unexpected result %v %v", res, err)
+	}
+	res, err = conn.Exec("kv.delete", map[string]interface{}{"key": key})
+	if err != nil || ei.N(res).M("deleted").BoolZ() {
+		t.Errorf("kv.delete missing key: unexpected result %v %v", res, err)
+	}
+}
+
+func TestKvCas(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	key := Prefix3 + ".kv.owner" + Suffix
+	if _, err := conn.Exec("kv.cas", map[string]interface{}{"key": key, "value": "a", "version": 0}); err != nil {
+		t.Fatalf("kv.cas create: %s", err.Error())
+	}
+	if _, err := conn.Exec("kv.cas", map[string]interface{}{"key": key, "value": "b", "version": 0}); !IsNexusErrCode(err, -32007) {
+		t.Errorf("kv.cas create existing: expecting version mismatch error")
+	}
+	res, err := conn.Exec("kv.cas", map[string]interface{}{"key": key, "value": "b", "version": 1})
+	if err != nil {
+		t.Errorf("kv.cas: %s", err.Error())
+	} else if ei.N(res).M("version").IntZ() != 2 || ei.N(res).M("value").StringZ() != "b" {
+		t.Errorf("kv.cas: unexpected result %v", res)
+	}
+
+	// Versions keep increasing after the key is deleted and created again
+	conn.Exec("kv.delete", map[string]interface{}{"key": key})
+	res, err = conn.Exec("kv.cas", map[string]interface{}{"key": key, "value": "c", "version": 0})
+	if err != nil {
+		t.Errorf("kv.cas recreate: %s", err.Error())
+	} else if ei.N(res).M("version").IntZ() != 3 {
+		t.Errorf("kv.cas recreate: expecting version 3, got %v", res)
+	}
+	if _, err := conn.Exec("kv.cas", map[string]interface{}{"key": key, "value": "d", "version": 1}); !IsNexusErrCode(err, -32007) {
+		t.Errorf("kv.cas with a version of the deleted key: expecting version mismatch error")
+	}
+	conn.Exec("kv.delete", map[string]interface{}{"key": key})
+}
+
+func TestKvTTL(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	key := Prefix3 + ".kv.session"
+	if _, err := conn.Exec("kv.set", map[string]interface{}{"key": key, "value": true, "ttl": 1}); err != nil {
+		t.Fatalf("kv.set with ttl: %s", err.Error())
+	}
+	time.Sleep(time.Millisecond * 1500)
+	res, err := conn.Exec("kv.get", map[string]interface{}{"key": key})
+	if err != nil {
+		t.Fatalf("kv.get: %s", err.Error())
+	}
+	if ei.N(res).M("version").IntZ() != 0 {
+		t.Errorf("kv.get expired key: unexpected result %v", res)
+	}
+	if _, err := conn.Exec("kv.cas", map[string]interface{}{"key": key, "value": true, "version": 0}); err != nil {
+		t.Errorf("kv.cas on expired key: %s", err.Error())
+	}
+	conn.Exec("kv.delete", map[string]interface{}{"key": key})
+}
+
+func TestWatch(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	pipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer pipe.Close()
+	prefix := Prefix3 + ".watched"
+	if _, err := conn.Exec("sync.watch", map[string]interface{}{"pipeid": pipe.Id(), "prefix": prefix}); err != nil {
+		t.Fatalf("sync.watch: %s", err.Error())
+	}
+	if _, err := conn.Exec("kv.watch", map[string]interface{}{"pipeid": pipe.Id(), "prefix": prefix}); err != nil {
+		t.Fatalf("kv.watch: %s", err.Error())
+	}
+
+	conn.Lock(prefix + ".lock")
+	conn.Unlock(prefix + ".lock")
+	conn.Lock(Prefix3 + ".unwatched")
+	conn.Unlock(Prefix3 + ".unwatched")
+	conn.Exec("kv.set", map[string]interface{}{"key": prefix + ".key", "value": 1})
+	conn.Exec("kv.delete", map[string]interface{}{"key": prefix + ".key"})
+
+	expected := []string{"locks acquired", "locks released", "kv updated", "kv deleted"}
+	events := []string{}
+	for len(events) < len(expected) {
+		data, err := pipe.Read(10, time.Second*2)
+		if err != nil || len(data.Msgs) == 0 {
+			break
+		}
+		for _, m := range data.Msgs {
+			events = append(events, ei.N(m.Msg).M("watch").StringZ()+" "+ei.N(m.Msg).M("event").StringZ())
+		}
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("pipe.read watch events: expecting %v, got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("pipe.read watch events: expecting %v, got %v", expected, events)
+			break
+		}
+	}
+
+	if _, err := conn.Exec("sync.unwatch", map[string]interface{}{"pipeid": pipe.Id(), "prefix": prefix}); err != nil {
+		t.Errorf("sync.unwatch: %s", err.Error())
+	}
+	conn.Lock(prefix + ".lock")
+	conn.Unlock(prefix + ".lock")
+	if data, err := pipe.Read(10, time.Millisecond*500); err == nil && len(data.Msgs) > 0 {
+		t.Errorf("pipe.read after sync.unwatch: expecting no events, got %d", len(data.Msgs))
+	}
+}
+
+func TestWatchBlockPipe(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	// A full block pipe drops the events instead of holding back the other watches
+	res, err := conn.Exec("pipe.create", map[string]interface{}{"len": 1, "overflow": "block", "blocktimeout": 5})
+	if err != nil {
+		t.Fatalf("pipe.create block: %s", err.Error())
+	}
+	bpipe, _ := conn.PipeOpen(ei.N(res).M("pipeid").StringZ())
+	defer bpipe.Close()
+	pipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer pipe.Close()
+	prefix := Prefix3 + ".blockwatched"
+	for _, p := range []string{bpipe.Id(), pipe.Id()} {
+		if _, err := conn.Exec("kv.watch", map[string]interface{}{"pipeid": p, "prefix": prefix}); err != nil {
+			t.Fatalf("kv.watch: %s", err.Error())
+		}
+	}
+
+	conn.Exec("kv.set", map[string]interface{}{"key": prefix + ".key", "value": 1})
+	conn.Exec("kv.delete", map[string]interface{}{"key": prefix + ".key"})
+	start := time.Now()
+	events := 0
+	for events < 2 {
+		data, err := pipe.Read(10, time.Second*2)
+		if err != nil || len(data.Msgs) == 0 {
+			break
+		}
+		events += len(data.Msgs)
+	}
+	if events != 2 || time.Since(start) > time.Second*3 {
+		t.Errorf("pipe.read watch events: expecting 2 events without waiting for the block pipe, got %d in %s", events, time.Since(start))
+	}
+	data, err := bpipe.Read(10, time.Second)
+	if err != nil || len(data.Msgs) != 1 || data.Drops != 1 {
+		t.Errorf("pipe.read block pipe: expecting 1 event and 1 drop, got %+v %v", data, err)
+	}
+}
@@ -12,6 +12,8 @@ import (
 )
 
 var NexusServer = "localhost:1717"
+var RethinkServer = "localhost:28015"
+var RethinkDatabase = "nexus"
 var RootSes *nexus.NexusConn
 
 var UserA = "testa"
@@ -32,6 +34,14 @@ func TestMain(m *testing.M) {
 		NexusServer = ns
 	}
 
+	// RethinkDB server, to check what nexus stores
+	if rs := os.Getenv("RETHINK_SERVER"); rs != "" {
+		RethinkServer = rs
+	}
+	if rd := os.Getenv("RETHINK_DATABASE"); rd != "" {
+		RethinkDatabase = rd
+	}
+
 	// Suffix
 	rand.Seed(time.Now().UnixNano())
 	Suffix = fmt.Sprintf("%04d", rand.Intn(9999))
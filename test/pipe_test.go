@@ -1,9 +1,13 @@
 package test
 
 import (
+	"encoding/json"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jaracil/ei"
 	nexus "github.com/nayarsystems/nxgo/nxcore"
 )
 
@@ -144,3 +148,411 @@ func TestPipeOverflow(t *testing.T) {
 	wconn.Close()
 	rconn.Close()
 }
+
+func TestPipeResume(t *testing.T) {
+	rconn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	wconn, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("sys.login userB: %s", err.Error())
+	}
+	defer wconn.Close()
+
+	res, err := rconn.Exec("pipe.create", map[string]interface{}{"resumable": true, "grace": 10})
+	if err != nil {
+		t.Fatalf("pipe.create resumable: %s", err.Error())
+	}
+	pipeId := ei.N(res).M("pipeid").StringZ()
+	token := ei.N(res).M("token").StringZ()
+	if token == "" {
+		t.Fatalf("pipe.create resumable: expecting a token")
+	}
+	wpipe, _ := wconn.PipeOpen(pipeId)
+	if _, err = wpipe.Write(1); err != nil {
+		t.Errorf("pipe.write: %s", err.Error())
+	}
+	time.Sleep(time.Millisecond * 100)
+	rconn.Close()
+	time.Sleep(time.Millisecond * 500)
+
+	// Messages written while detached are kept
+	if _, err = wpipe.Write(2); err != nil {
+		t.Errorf("pipe.write detached: %s", err.Error())
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	rconn, err = login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer rconn.Close()
+	if _, err = rconn.Exec("pipe.attach", map[string]interface{}{"pipeid": pipeId, "token": "bad"}); !IsNexusErrCode(err, nexus.ErrInvalidPipe) {
+		t.Errorf("pipe.attach bad token: expecting ErrInvalidPipe")
+	}
+	if _, err = rconn.Exec("pipe.attach", map[string]interface{}{"pipeid": pipeId, "token": token}); err != nil {
+		t.Fatalf("pipe.attach: %s", err.Error())
+	}
+	rpipe, _ := rconn.PipeOpen(pipeId)
+	pipeData, err := rpipe.Read(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read attached: %s", err.Error())
+	}
+	if len(pipeData.Msgs) != 2 {
+		t.Fatalf("pipe.read attached: expecting 2 messages: got %d", len(pipeData.Msgs))
+	}
+	if pipeData.Msgs[1].Count != 2 {
+		t.Errorf("pipe.read attached: expecting count 2: got %d", pipeData.Msgs[1].Count)
+	}
+	if _, err = rpipe.Close(); err != nil {
+		t.Errorf("pipe.close: %s", err.Error())
+	}
+}
+
+func TestPipeAck(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	res, err := conn.Exec("pipe.create", map[string]interface{}{"ack": true, "acktimeout": 0.5})
+	if err != nil {
+		t.Fatalf("pipe.create ack: %s", err.Error())
+	}
+	pipeId := ei.N(res).M("pipeid").StringZ()
+	pipe, _ := conn.PipeOpen(pipeId)
+	for i := 1; i <= 2; i++ {
+		if _, err = pipe.Write(i); err != nil {
+			t.Errorf("pipe.write: %s", err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	res, err = conn.Exec("pipe.read", map[string]interface{}{"pipeid": pipeId, "max": 10, "timeout": 1})
+	if err != nil {
+		t.Fatalf("pipe.read: %s", err.Error())
+	}
+	if n := len(ei.N(res).M("msgs").SliceZ()); n != 2 {
+		t.Fatalf("pipe.read: expecting 2 messages: got %d", n)
+	}
+	if ei.N(res).M("pending").IntZ() != 2 {
+		t.Errorf("pipe.read: expecting 2 pending messages")
+	}
+	res, err = conn.Exec("pipe.ack", map[string]interface{}{"pipeid": pipeId, "count": 1})
+	if err != nil {
+		t.Fatalf("pipe.ack: %s", err.Error())
+	}
+	if ei.N(res).M("acked").IntZ() != 1 {
+		t.Errorf("pipe.ack: expecting 1 acked message")
+	}
+
+	// The unacknowledged message is redelivered
+	res, err = conn.Exec("pipe.read", map[string]interface{}{"pipeid": pipeId, "max": 10, "timeout": 2})
+	if err != nil {
+		t.Fatalf("pipe.read redelivery: %s", err.Error())
+	}
+	msgs := ei.N(res).M("msgs").SliceZ()
+	if len(msgs) != 1 {
+		t.Fatalf("pipe.read redelivery: expecting 1 message: got %d", len(msgs))
+	}
+	if ei.N(msgs[0]).M("count").IntZ() != 2 || !ei.N(msgs[0]).M("redelivered").BoolZ() {
+		t.Errorf("pipe.read redelivery: expecting message 2 redelivered: got %v", msgs[0])
+	}
+	if _, err = conn.Exec("pipe.ack", map[string]interface{}{"pipeid": pipeId, "count": []int{2}}); err != nil {
+		t.Errorf("pipe.ack list: %s", err.Error())
+	}
+	if _, err = pipe.Close(); err != nil {
+		t.Errorf("pipe.close: %s", err.Error())
+	}
+}
+
+func TestPipeInfoPeekPurge(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	pipe, err := conn.PipeCreate(&nexus.PipeOpts{Length: 5})
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	pipeId := pipe.Id()
+	for i := 1; i <= 4; i++ {
+		if _, err = pipe.Write(i); err != nil {
+			t.Errorf("pipe.write: %s", err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	res, err := conn.Exec("pipe.info", map[string]interface{}{"pipeid": pipeId})
+	if err != nil {
+		t.Fatalf("pipe.info: %s", err.Error())
+	}
+	if ei.N(res).M("length").IntZ() != 4 || ei.N(res).M("capacity").IntZ() != 5 {
+		t.Errorf("pipe.info: expecting length 4 and capacity 5: got %v", res)
+	}
+	if ei.N(res).M("waiting").IntZ() != 4 || ei.N(res).M("readers").IntZ() != 0 {
+		t.Errorf("pipe.info: expecting 4 waiting messages and no readers: got %v", res)
+	}
+
+	res, err = conn.Exec("pipe.peek", map[string]interface{}{"pipeid": pipeId, "max": 2})
+	if err != nil {
+		t.Fatalf("pipe.peek: %s", err.Error())
+	}
+	msgs := ei.N(res).M("msgs").SliceZ()
+	if len(msgs) != 2 || ei.N(msgs[0]).M("count").IntZ() != 1 {
+		t.Errorf("pipe.peek: expecting messages 1 and 2: got %v", msgs)
+	}
+	if ei.N(res).M("waiting").IntZ() != 4 {
+		t.Errorf("pipe.peek: expecting 4 waiting messages")
+	}
+
+	res, err = conn.Exec("pipe.purge", map[string]interface{}{"pipeid": pipeId, "n": 3})
+	if err != nil {
+		t.Fatalf("pipe.purge: %s", err.Error())
+	}
+	if ei.N(res).M("purged").IntZ() != 3 {
+		t.Errorf("pipe.purge: expecting 3 purged messages")
+	}
+	pipeData, err := pipe.Read(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read: %s", err.Error())
+	}
+	if len(pipeData.Msgs) != 1 || pipeData.Msgs[0].Count != 4 {
+		t.Errorf("pipe.read: expecting only message 4 after purge")
+	}
+
+	if _, err = pipe.Write(5); err != nil {
+		t.Errorf("pipe.write: %s", err.Error())
+	}
+	time.Sleep(time.Millisecond * 100)
+	if res, err = conn.Exec("pipe.purge", map[string]interface{}{"pipeid": pipeId}); err != nil || ei.N(res).M("waiting").IntZ() != 0 {
+		t.Errorf("pipe.purge all: expecting an empty pipe")
+	}
+	if _, err = pipe.Close(); err != nil {
+		t.Errorf("pipe.close: %s", err.Error())
+	}
+}
+
+func TestPipeOverflowPolicy(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	if _, err = conn.Exec("pipe.create", map[string]interface{}{"overflow": "whatever"}); !IsNexusErrCode(err, nexus.ErrInvalidParams) {
+		t.Errorf("pipe.create invalid overflow: expecting ErrInvalidParams")
+	}
+
+	// Drop oldest keeps the latest messages
+	res, err := conn.Exec("pipe.create", map[string]interface{}{"len": 3, "overflow": "dropold"})
+	if err != nil {
+		t.Fatalf("pipe.create dropold: %s", err.Error())
+	}
+	dpipe, _ := conn.PipeOpen(ei.N(res).M("pipeid").StringZ())
+	for i := 1; i <= 5; i++ {
+		if _, err = dpipe.Write(i); err != nil {
+			t.Errorf("pipe.write dropold: %s", err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	pipeData, err := dpipe.Read(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read dropold: %s", err.Error())
+	}
+	if len(pipeData.Msgs) != 3 || pipeData.Msgs[0].Count != 3 {
+		t.Errorf("pipe.read dropold: expecting messages 3 to 5: got %+v", pipeData.Msgs)
+	}
+	if pipeData.Drops != 2 {
+		t.Errorf("pipe.read dropold: expecting 2 drops: got %d", pipeData.Drops)
+	}
+	dpipe.Close()
+
+	// Block makes the writer wait for room
+	res, err = conn.Exec("pipe.create", map[string]interface{}{"len": 2, "overflow": "block", "blocktimeout": 0.5})
+	if err != nil {
+		t.Fatalf("pipe.create block: %s", err.Error())
+	}
+	bpipe, _ := conn.PipeOpen(ei.N(res).M("pipeid").StringZ())
+	for i := 1; i <= 2; i++ {
+		if _, err = bpipe.Write(i); err != nil {
+			t.Errorf("pipe.write block: %s", err.Error())
+		}
+	}
+	if _, err = bpipe.Write(3); !IsNexusErrCode(err, nexus.ErrTimeout) {
+		t.Errorf("pipe.write full block pipe: expecting ErrTimeout")
+	}
+	if _, err = bpipe.Read(10, time.Second); err != nil {
+		t.Fatalf("pipe.read block: %s", err.Error())
+	}
+	if _, err = bpipe.Write(3); err != nil {
+		t.Errorf("pipe.write block after read: %s", err.Error())
+	}
+	bpipe.Close()
+}
+
+func TestPipeStream(t *testing.T) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(NexusServer, "tcp://"))
+	if err != nil {
+		t.Fatalf("dial: %s", err.Error())
+	}
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	notifs := 0
+	exec := func(id int, method string, params interface{}) map[string]interface{} {
+		enc.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+		for {
+			var msg map[string]interface{}
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			if err := dec.Decode(&msg); err != nil {
+				t.Fatalf("%s: %s", method, err.Error())
+			}
+			if ei.N(msg).M("method").StringZ() == "pipe.msg" {
+				notifs++
+				continue
+			}
+			if ei.N(msg).M("id").IntZ() == id {
+				return msg
+			}
+		}
+	}
+
+	exec(1, "sys.login", map[string]interface{}{"user": UserA, "pass": UserA})
+	pipeId := ei.N(exec(2, "pipe.create", nil)).M("result").M("pipeid").StringZ()
+	for i := 1; i <= 3; i++ {
+		exec(2+i, "pipe.write", map[string]interface{}{"pipeid": pipeId, "msg": i})
+	}
+	res := exec(6, "pipe.stream", map[string]interface{}{"pipeid": pipeId, "credit": 2})
+	if ei.N(res).M("result").M("credit").IntZ() != 2 {
+		t.Errorf("pipe.stream: expecting credit 2: got %v", res)
+	}
+
+	// Only as many messages as credit given are pushed
+	var msg map[string]interface{}
+	for notifs < 2 {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatalf("pipe.msg: %s", err.Error())
+		}
+		if ei.N(msg).M("method").StringZ() == "pipe.msg" {
+			notifs++
+			if ei.N(msg).M("params").M("count").IntZ() != notifs {
+				t.Errorf("pipe.msg: expecting count %d: got %v", notifs, msg)
+			}
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	if err := dec.Decode(&msg); err == nil {
+		t.Errorf("pipe.msg: not expecting more messages without credit: got %v", msg)
+	}
+}
+
+func TestPipeShared(t *testing.T) {
+	conn1, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn1.Close()
+	conn2, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn2.Close()
+	bconn, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("sys.login userB: %s", err.Error())
+	}
+	defer bconn.Close()
+
+	name := Prefix1 + ".shared" + Suffix
+	res, err := conn1.Exec("pipe.create", map[string]interface{}{"shared": name})
+	if err != nil {
+		t.Fatalf("pipe.create shared: %s", err.Error())
+	}
+	pipeId := ei.N(res).M("pipeid").StringZ()
+	if pipeId != "@"+name {
+		t.Errorf("pipe.create shared: unexpected pipeid %s", pipeId)
+	}
+	if res, err = conn2.Exec("pipe.create", map[string]interface{}{"shared": name}); err != nil || ei.N(res).M("pipeid").StringZ() != pipeId {
+		t.Errorf("pipe.create existing shared pipe by owner: expecting the same pipe")
+	}
+	if _, err = bconn.Exec("pipe.create", map[string]interface{}{"shared": name}); !IsNexusErrCode(err, nexus.ErrPermissionDenied) {
+		t.Errorf("pipe.create shared pipe of another user: expecting ErrPermissionDenied")
+	}
+	if _, err = conn1.Exec("pipe.create", map[string]interface{}{"shared": true}); !IsNexusErrCode(err, nexus.ErrInvalidParams) {
+		t.Errorf("pipe.create shared with a non string name: expecting ErrInvalidParams")
+	}
+
+	bpipe, _ := bconn.PipeOpen(pipeId)
+	for i := 1; i <= 3; i++ {
+		if _, err = bpipe.Write(i); err != nil {
+			t.Errorf("pipe.write shared: %s", err.Error())
+		}
+	}
+
+	// Competing readers get each message once
+	pipe1, _ := conn1.PipeOpen(pipeId)
+	pipe2, _ := conn2.PipeOpen(pipeId)
+	data1, err := pipe1.Read(2, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read shared: %s", err.Error())
+	}
+	data2, err := pipe2.Read(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read shared: %s", err.Error())
+	}
+	if len(data1.Msgs) != 2 || len(data2.Msgs) != 1 {
+		t.Fatalf("pipe.read shared: expecting 2 and 1 messages: got %d and %d", len(data1.Msgs), len(data2.Msgs))
+	}
+	if data1.Msgs[0].Count != 1 || data2.Msgs[0].Count != 3 {
+		t.Errorf("pipe.read shared: unexpected message order")
+	}
+
+	// Blocked readers are woken up by new messages
+	go func() {
+		time.Sleep(time.Millisecond * 300)
+		bpipe.Write(4)
+	}()
+	data2, err = pipe2.Read(10, time.Second*5)
+	if err != nil || len(data2.Msgs) != 1 || data2.Msgs[0].Count != 4 {
+		t.Errorf("pipe.read shared blocking: expecting message 4")
+	}
+
+	// Reads timing out report the pipe drops too
+	res, err = conn1.Exec("pipe.create", map[string]interface{}{"shared": name + "small", "len": 1})
+	if err != nil {
+		t.Fatalf("pipe.create shared: %s", err.Error())
+	}
+	small := ei.N(res).M("pipeid").StringZ()
+	bsmall, _ := bconn.PipeOpen(small)
+	bsmall.Write(1)
+	bsmall.Write(2)
+	res, err = conn1.Exec("pipe.read", map[string]interface{}{"pipeid": small, "max": 10, "timeout": 0.5})
+	if err != nil || len(ei.N(res).M("msgs").SliceZ()) != 1 {
+		t.Errorf("pipe.read shared full pipe: expecting 1 message")
+	}
+	res, err = conn1.Exec("pipe.read", map[string]interface{}{"pipeid": small, "max": 10, "timeout": 0.5})
+	if err != nil || len(ei.N(res).M("msgs").SliceZ()) != 0 || ei.N(res).M("drops").IntZ() != 1 {
+		t.Errorf("pipe.read shared timing out: expecting no messages and 1 drop: got %v", res)
+	}
+	conn1.Exec("pipe.close", map[string]interface{}{"pipeid": small})
+
+	// The pipe is only deleted when its last owner closes it
+	if _, err = pipe2.Close(); err != nil {
+		t.Errorf("pipe.close shared: %s", err.Error())
+	}
+	if _, err = bpipe.Write(5); err != nil {
+		t.Errorf("pipe.write shared after closing one owner: %s", err.Error())
+	}
+	if _, err = pipe1.Close(); err != nil {
+		t.Errorf("pipe.close shared: %s", err.Error())
+	}
+	if _, err = bpipe.Write(6); !IsNexusErrCode(err, nexus.ErrInvalidPipe) {
+		t.Errorf("pipe.write shared after closing all owners: expecting ErrInvalidPipe")
+	}
+}
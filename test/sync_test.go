@@ -1,9 +1,11 @@
 package test
 
 import (
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jaracil/ei"
 	"github.com/nayarsystems/nxgo/nxcore"
 )
 
@@ -103,3 +105,522 @@ func TestSyncUnlockSesClose(t *testing.T) {
 	}
 	sesa.Unlock(Prefix3)
 }
+
+func TestSyncLockTTL(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+
+	lock := Prefix3 + ".ttl"
+	if _, err := sesa.Exec("sync.lock", map[string]interface{}{"lock": lock, "ttl": 2}); err != nil {
+		t.Fatalf("sync.lock with ttl: %s", err.Error())
+	}
+
+	// Refreshing keeps the lock alive past the first ttl
+	time.Sleep(time.Second * 1)
+	if _, err := sesa.Exec("sync.refresh", map[string]interface{}{"lock": lock}); err != nil {
+		t.Errorf("sync.refresh: %s", err.Error())
+	}
+	if _, err := sesb.Exec("sync.refresh", map[string]interface{}{"lock": lock}); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.refresh from another session: expecting lock not owned error")
+	}
+	time.Sleep(time.Millisecond * 1500)
+	if _, err := sesb.Lock(lock); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.lock refreshed lock: expecting lock not owned error")
+	}
+
+	// Once expired the lock can be grabbed by another session
+	time.Sleep(time.Second * 3)
+	if _, err := sesb.Lock(lock); err != nil {
+		t.Errorf("sync.lock expired lock: %s", err.Error())
+	}
+	if _, err := sesa.Unlock(lock); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.unlock expired lock: expecting lock not owned error")
+	}
+
+	// A lock grabbed without ttl needs one to be refreshed
+	if _, err := sesb.Exec("sync.refresh", map[string]interface{}{"lock": lock}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("sync.refresh without ttl: expecting invalid params error")
+	}
+	if _, err := sesb.Exec("sync.refresh", map[string]interface{}{"lock": lock, "ttl": 10}); err != nil {
+		t.Errorf("sync.refresh setting a ttl: %s", err.Error())
+	}
+	sesb.Unlock(lock)
+}
+
+func TestSyncLockWait(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	sesc, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+	defer sesc.Close()
+
+	lock := Prefix3 + ".wait"
+	if _, err := sesa.Lock(lock); err != nil {
+		t.Fatalf("sync.lock: %s", err.Error())
+	}
+
+	// Time out while the lock is busy
+	if _, err := sesb.Exec("sync.lock", map[string]interface{}{"lock": lock, "wait": 0.5}); !IsNexusErrCode(err, nxcore.ErrTimeout) {
+		t.Errorf("sync.lock wait on busy lock: expecting timeout error")
+	}
+
+	// Waiters are granted the lock in arrival order
+	order := make(chan string, 2)
+	go func() {
+		if _, err := sesb.Exec("sync.lock", map[string]interface{}{"lock": lock, "wait": 5}); err == nil {
+			order <- "b"
+		}
+	}()
+	time.Sleep(time.Millisecond * 300)
+	go func() {
+		if _, err := sesc.Exec("sync.lock", map[string]interface{}{"lock": lock, "wait": 5}); err == nil {
+			order <- "c"
+		}
+	}()
+	time.Sleep(time.Millisecond * 300)
+
+	// Nobody can jump the queue
+	sesa.Unlock(lock)
+	if _, err := sesa.Lock(lock); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.lock with waiters queued: expecting lock not owned error")
+	}
+	select {
+	case first := <-order:
+		if first != "b" {
+			t.Errorf("sync.lock wait: expecting first waiter to get the lock, got %s", first)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("sync.lock wait: timeout waiting for the lock")
+	}
+	sesb.Unlock(lock)
+	select {
+	case <-order:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("sync.lock wait: timeout waiting for the lock")
+	}
+	sesc.Unlock(lock)
+}
+
+func TestSyncLockShared(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	sesc, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+	defer sesc.Close()
+
+	lock := Prefix3 + ".shared"
+	shared := map[string]interface{}{"lock": lock, "mode": "shared"}
+	if _, err := sesa.Exec("sync.lock", shared); err != nil {
+		t.Fatalf("sync.lock shared: %s", err.Error())
+	}
+	if _, err := sesb.Exec("sync.lock", shared); err != nil {
+		t.Errorf("sync.lock shared held: %s", err.Error())
+	}
+	if _, err := sesc.Lock(lock); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.lock exclusive on shared: expecting lock not owned error")
+	}
+
+	// The last holder leaving frees the lock, even on disconnect
+	if _, err := sesa.Unlock(lock); err != nil {
+		t.Errorf("sync.unlock shared: %s", err.Error())
+	}
+	if _, err := sesc.Lock(lock); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.lock exclusive on shared: expecting lock not owned error")
+	}
+	sesb.Close()
+	<-sesb.GetContext().Done()
+	time.Sleep(time.Second * 1)
+	if _, err := sesc.Lock(lock); err != nil {
+		t.Errorf("sync.lock exclusive on freed shared: %s", err.Error())
+	}
+	if _, err := sesa.Exec("sync.lock", shared); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.lock shared on exclusive: expecting lock not owned error")
+	}
+	sesc.Unlock(lock)
+}
+
+func TestSyncLockSharedLeases(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+
+	// The lease of a holder only expires its own share of the lock
+	lock := Prefix3 + ".shared.leases"
+	if _, err := sesa.Exec("sync.lock", map[string]interface{}{"lock": lock, "mode": "shared", "ttl": 1}); err != nil {
+		t.Fatalf("sync.lock shared with ttl: %s", err.Error())
+	}
+	if _, err := sesb.Exec("sync.lock", map[string]interface{}{"lock": lock, "mode": "shared"}); err != nil {
+		t.Fatalf("sync.lock shared: %s", err.Error())
+	}
+	if _, err := sesb.Exec("sync.refresh", map[string]interface{}{"lock": lock}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("sync.refresh without lease: expecting invalid params error")
+	}
+	time.Sleep(time.Second * 3)
+	res, err := sesa.Exec("sync.info", map[string]interface{}{"lock": lock})
+	if err != nil {
+		t.Fatalf("sync.info: %s", err.Error())
+	}
+	if !ei.N(res).M("locked").BoolZ() || len(ei.N(res).M("owners").SliceZ()) != 1 {
+		t.Errorf("sync.info after a lease expired: expecting a single holder: got %v", res)
+	}
+	if _, err := sesa.Unlock(lock); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.unlock after the lease expired: expecting lock not owned error")
+	}
+	if _, err := sesb.Unlock(lock); err != nil {
+		t.Errorf("sync.unlock shared: %s", err.Error())
+	}
+}
+
+func TestSyncSemaphore(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	sesc, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+	defer sesc.Close()
+
+	sem := Prefix3 + ".sem"
+	acquire := map[string]interface{}{"sem": sem, "capacity": 2}
+	if _, err := sesa.Exec("sync.semAcquire", acquire); err != nil {
+		t.Fatalf("sync.semAcquire: %s", err.Error())
+	}
+	if _, err := sesb.Exec("sync.semAcquire", acquire); err != nil {
+		t.Errorf("sync.semAcquire: %s", err.Error())
+	}
+	if _, err := sesc.Exec("sync.semAcquire", acquire); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.semAcquire full: expecting lock not owned error")
+	}
+	if _, err := sesc.Exec("sync.semAcquire", map[string]interface{}{"sem": sem, "capacity": 3}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("sync.semAcquire with another capacity: expecting invalid params error")
+	}
+
+	res, err := sesa.Exec("sync.list", map[string]interface{}{"prefix": sem})
+	if err != nil {
+		t.Errorf("sync.list: %s", err.Error())
+	} else if ei.N(res).S(0).M("capacity").IntZ() != 2 || len(ei.N(res).S(0).M("owners").SliceZ()) != 2 {
+		t.Errorf("sync.list: unexpected semaphore %v", res)
+	}
+
+	// A slot freed on disconnect goes to the waiting session
+	done := make(chan error, 1)
+	go func() {
+		_, err := sesc.Exec("sync.semAcquire", map[string]interface{}{"sem": sem, "capacity": 2, "wait": 5})
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 300)
+	sesb.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("sync.semAcquire wait: %s", err.Error())
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("sync.semAcquire wait: timeout waiting for a slot")
+	}
+
+	if _, err := sesa.Exec("sync.semRelease", map[string]interface{}{"sem": sem}); err != nil {
+		t.Errorf("sync.semRelease: %s", err.Error())
+	}
+	if _, err := sesa.Exec("sync.semRelease", map[string]interface{}{"sem": sem}); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.semRelease not held: expecting lock not owned error")
+	}
+	sesc.Exec("sync.semRelease", map[string]interface{}{"sem": sem})
+}
+
+func TestSyncFencingToken(t *testing.T) {
+	ses, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	defer ses.Close()
+
+	lock := Prefix3 + ".fence"
+	res, err := ses.Exec("sync.lock", map[string]interface{}{"lock": lock})
+	if err != nil {
+		t.Fatalf("sync.lock: %s", err.Error())
+	}
+	first := ei.N(res).M("token").Int64Z()
+	if first <= 0 {
+		t.Errorf("sync.lock: expecting a fencing token, got %v", res)
+	}
+	res, err = ses.Exec("sync.info", map[string]interface{}{"lock": lock})
+	if err != nil {
+		t.Errorf("sync.info: %s", err.Error())
+	} else if !ei.N(res).M("locked").BoolZ() || ei.N(res).M("token").Int64Z() != first {
+		t.Errorf("sync.info: unexpected result %v", res)
+	}
+	ses.Unlock(lock)
+
+	res, err = ses.Exec("sync.lock", map[string]interface{}{"lock": lock})
+	if err != nil {
+		t.Fatalf("sync.lock: %s", err.Error())
+	}
+	if second := ei.N(res).M("token").Int64Z(); second <= first {
+		t.Errorf("sync.lock: expecting token greater than %d, got %d", first, second)
+	}
+	ses.Unlock(lock)
+	res, err = ses.Exec("sync.info", map[string]interface{}{"lock": lock})
+	if err != nil {
+		t.Errorf("sync.info: %s", err.Error())
+	} else if ei.N(res).M("locked").BoolZ() || ei.N(res).M("token").Int64Z() != first+1 {
+		t.Errorf("sync.info: unexpected result %v", res)
+	}
+}
+
+// Grab a lock from many sessions at once, returning the tokens of the ones granted
+func syncLockConcurrently(t *testing.T, method string, params map[string]interface{}) []int64 {
+	sessions := make([]*nxcore.NexusConn, 0)
+	for i := 0; i < 8; i++ {
+		ses, err := login(UserA, UserA)
+		if err != nil {
+			t.Fatalf("login with UserA: %s", err.Error())
+		}
+		defer ses.Close()
+		sessions = append(sessions, ses)
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	tokens := make([]int64, 0)
+	for _, ses := range sessions {
+		wg.Add(1)
+		go func(ses *nxcore.NexusConn) {
+			defer wg.Done()
+			res, err := ses.Exec(method, params)
+			if err != nil {
+				if !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+					t.Errorf("%s: %s", method, err.Error())
+				}
+				return
+			}
+			mutex.Lock()
+			tokens = append(tokens, ei.N(res).M("token").Int64Z())
+			mutex.Unlock()
+		}(ses)
+	}
+	wg.Wait()
+	return tokens
+}
+
+func TestSyncLockConcurrent(t *testing.T) {
+	// A single session wins an exclusive lock
+	tokens := syncLockConcurrently(t, "sync.lock", map[string]interface{}{"lock": Prefix3 + ".concurrent" + Suffix})
+	if len(tokens) != 1 {
+		t.Errorf("sync.lock from many sessions at once: expecting a single holder: got %d", len(tokens))
+	}
+
+	// A semaphore is never held past its capacity, and each holder gets its own token
+	tokens = syncLockConcurrently(t, "sync.semAcquire", map[string]interface{}{"sem": Prefix3 + ".concurrent.sem" + Suffix, "capacity": 2})
+	if len(tokens) != 2 {
+		t.Errorf("sync.semAcquire from many sessions at once: expecting 2 holders: got %d", len(tokens))
+	} else if tokens[0] == tokens[1] || tokens[0] <= 0 || tokens[1] <= 0 {
+		t.Errorf("sync.semAcquire from many sessions at once: expecting distinct tokens: got %v", tokens)
+	}
+}
+
+func TestSyncElection(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+
+	election := Prefix3 + ".election"
+	res, err := sesa.Exec("sync.elect", map[string]interface{}{"election": election})
+	if err != nil {
+		t.Fatalf("sync.elect: %s", err.Error())
+	}
+	if !ei.N(res).M("elected").BoolZ() {
+		t.Errorf("sync.elect: expecting first candidate to be elected")
+	}
+	leader := ei.N(res).M("leader").StringZ()
+	if _, err := sesa.Exec("sync.elect", map[string]interface{}{"election": election}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("sync.elect twice: expecting invalid params error")
+	}
+	res, err = sesb.Exec("sync.elect", map[string]interface{}{"election": election})
+	if err != nil {
+		t.Fatalf("sync.elect: %s", err.Error())
+	}
+	if ei.N(res).M("elected").BoolZ() || ei.N(res).M("leader").StringZ() != leader {
+		t.Errorf("sync.elect: unexpected result %v", res)
+	}
+
+	// The leadership goes to the next candidate
+	if _, err := sesa.Exec("sync.resign", map[string]interface{}{"election": election}); err != nil {
+		t.Errorf("sync.resign: %s", err.Error())
+	}
+	time.Sleep(time.Millisecond * 500)
+	res, err = sesb.Exec("sync.leader", map[string]interface{}{"election": election})
+	if err != nil {
+		t.Errorf("sync.leader: %s", err.Error())
+	} else if !ei.N(res).M("elected").BoolZ() || ei.N(res).M("leader").StringZ() == leader {
+		t.Errorf("sync.leader: expecting second candidate to be elected, got %v", res)
+	}
+	if _, err := sesa.Exec("sync.resign", map[string]interface{}{"election": election}); !IsNexusErrCode(err, nxcore.ErrLockNotOwned) {
+		t.Errorf("sync.resign not candidate: expecting lock not owned error")
+	}
+
+	// Disconnecting gives up the leadership
+	sesb.Close()
+	<-sesb.GetContext().Done()
+	time.Sleep(time.Second * 1)
+	res, err = sesa.Exec("sync.leader", map[string]interface{}{"election": election})
+	if err != nil {
+		t.Errorf("sync.leader: %s", err.Error())
+	} else if ei.N(res).M("leader").StringZ() != "" {
+		t.Errorf("sync.leader: expecting no leader, got %v", res)
+	}
+}
+
+func TestSyncBarrier(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+
+	barrier := Prefix3 + ".barrier"
+	if _, err := sesa.Exec("sync.barrier", map[string]interface{}{"barrier": barrier, "parties": 2, "timeout": 0.5}); !IsNexusErrCode(err, nxcore.ErrTimeout) {
+		t.Errorf("sync.barrier alone: expecting timeout error")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sesa.Exec("sync.barrier", map[string]interface{}{"barrier": barrier, "parties": 2, "timeout": 5})
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 300)
+	if _, err := sesb.Exec("sync.barrier", map[string]interface{}{"barrier": barrier, "parties": 2, "timeout": 5}); err != nil {
+		t.Errorf("sync.barrier: %s", err.Error())
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("sync.barrier: %s", err.Error())
+		}
+	case <-time.After(time.Second * 3):
+		t.Errorf("sync.barrier: timeout waiting for the barrier release")
+	}
+}
+
+func TestSyncLatch(t *testing.T) {
+	sesa, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("login with UserA: %s", err.Error())
+	}
+	sesb, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	defer sesa.Close()
+	defer sesb.Close()
+
+	latch := Prefix3 + ".latch"
+	if _, err := sesa.Exec("sync.latch", map[string]interface{}{"latch": latch, "count": 2}); err != nil {
+		t.Fatalf("sync.latch: %s", err.Error())
+	}
+	if _, err := sesb.Exec("sync.latch", map[string]interface{}{"latch": latch, "count": 2}); err != nil {
+		t.Errorf("sync.latch existing with the same count: %s", err.Error())
+	}
+	if _, err := sesb.Exec("sync.latch", map[string]interface{}{"latch": latch, "count": 3}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("sync.latch existing with another count: expecting invalid params error")
+	}
+	if _, err := sesa.Exec("sync.await", map[string]interface{}{"latch": latch, "timeout": 0.5}); !IsNexusErrCode(err, nxcore.ErrTimeout) {
+		t.Errorf("sync.await closed: expecting timeout error")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sesa.Exec("sync.await", map[string]interface{}{"latch": latch, "timeout": 5})
+		done <- err
+	}()
+	// Countdowns are discarded when the session doing them ends before the latch opens
+	worker, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("login with UserB: %s", err.Error())
+	}
+	res, err := worker.Exec("sync.countDown", map[string]interface{}{"latch": latch})
+	if err != nil || ei.N(res).M("remaining").IntZ() != 1 {
+		t.Errorf("sync.countDown: expecting 1 remaining, got %v %v", res, err)
+	}
+	worker.Close()
+	<-worker.GetContext().Done()
+	time.Sleep(time.Second * 1)
+	res, err = sesb.Exec("sync.countDown", map[string]interface{}{"latch": latch})
+	if err != nil || ei.N(res).M("remaining").IntZ() != 1 {
+		t.Errorf("sync.countDown: expecting 1 remaining, got %v %v", res, err)
+	}
+	res, err = sesb.Exec("sync.countDown", map[string]interface{}{"latch": latch})
+	if err != nil || ei.N(res).M("remaining").IntZ() != 0 {
+		t.Errorf("sync.countDown: expecting 0 remaining, got %v %v", res, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("sync.await: %s", err.Error())
+		}
+	case <-time.After(time.Second * 3):
+		t.Errorf("sync.await: timeout waiting for the latch")
+	}
+
+	// The latch is gone with its owner
+	sesa.Close()
+	<-sesa.GetContext().Done()
+	time.Sleep(time.Second * 1)
+	if _, err := sesb.Exec("sync.await", map[string]interface{}{"latch": latch, "timeout": 0.5}); !IsNexusErrCode(err, nxcore.ErrInvalidParams) {
+		t.Errorf("sync.await deleted latch: expecting invalid params error")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jaracil/ei"
 	nexus "github.com/nayarsystems/nxgo/nxcore"
 )
 
@@ -297,3 +298,49 @@ func TestTaskCancel(t *testing.T) {
 	}
 	<-donech
 }
+
+func TestTaskCached(t *testing.T) {
+	pushconn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer pushconn.Close()
+	pullconn, err := login(UserB, UserB)
+	if err != nil {
+		t.Fatalf("sys.login userB: %s", err.Error())
+	}
+	defer pullconn.Close()
+
+	params := map[string]interface{}{"n": Suffix}
+	go func() {
+		task, err := pullconn.TaskPull(Prefix4+".cached", time.Second*20)
+		if err != nil {
+			t.Errorf("task.pull: %s", err.Error())
+			return
+		}
+		task.SendResult(42)
+	}()
+	res, err := pushconn.TaskPush(Prefix4+".cached.method", params, time.Second*20)
+	if err != nil {
+		t.Fatalf("task.push: %s", err.Error())
+	}
+	if ei.N(res).IntZ() != 42 {
+		t.Errorf("task.push: expecting 42 got %v", res)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// Nobody is pulling, so it must be answered from the cache
+	res, err = pushconn.TaskPush(Prefix4+".cached.method", params, time.Second*2)
+	if err != nil {
+		t.Fatalf("task.push cached: %s", err.Error())
+	}
+	if ei.N(res).IntZ() != 42 {
+		t.Errorf("task.push cached: expecting 42 got %v", res)
+	}
+
+	// Different params are not cached
+	_, err = pushconn.TaskPush(Prefix4+".cached.method", "other", time.Second*1)
+	if !IsNexusErrCode(err, nexus.ErrTimeout) {
+		t.Errorf("task.push not cached: expecting timeout")
+	}
+}
@@ -27,7 +27,7 @@ x docker pull nayarsystems/nexus
 x go build ..
 
 # Run nexus in a docker container with the built binary
-x docker run -d -p 1717:1717 -p 8888:80 -v $DIR/nexus:/nexus nayarsystems/nexus -l http://0.0.0.0:80 -l tcp://0.0.0.0:1717
+x docker run -d -p 1717:1717 -p 8888:80 -v $DIR/nexus:/nexus nayarsystems/nexus -l http://0.0.0.0:80 -l tcp://0.0.0.0:1717 --taskcache prefix4.cached:60 --topicstream prefix4.stream:3600 --hidepublisher prefix4.hidden
 CONTAINER_ID=$XOUTPUT
 
 # Wait until nexus responds on http interface (or timeout)
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -174,3 +175,328 @@ func TestTopicSubscribePublish(t *testing.T) {
 	sub1conn.Close()
 	sub2conn.Close()
 }
+
+func TestTopicRetained(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	topic := Prefix4 + ".retained" + Suffix
+	for i := 1; i <= 2; i++ {
+		if _, err = conn.Exec("topic.pub", map[string]interface{}{"topic": topic + ".status", "msg": i, "retain": true}); err != nil {
+			t.Errorf("topic.pub retain: %s", err.Error())
+		}
+	}
+
+	// Only the last retained message is delivered, also to wildcard subscriptions
+	pipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer pipe.Close()
+	res, err := conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic + ".*"})
+	if err != nil {
+		t.Fatalf("topic.sub: %s", err.Error())
+	}
+	if ei.N(res).M("retained").IntZ() != 1 {
+		t.Errorf("topic.sub: expecting 1 retained message: got %v", res)
+	}
+	topicData, err := pipe.TopicRead(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read from topic: %s", err.Error())
+	}
+	if len(topicData.Msgs) != 1 || ei.N(topicData.Msgs[0].Msg).IntZ() != 2 || topicData.Msgs[0].Topic != topic+".status" {
+		t.Errorf("pipe.read from topic: expecting retained message 2: got %+v", topicData.Msgs)
+	}
+
+	res, err = conn.Exec("topic.clear", map[string]interface{}{"topic": topic + ".*"})
+	if err != nil {
+		t.Fatalf("topic.clear: %s", err.Error())
+	}
+	if ei.N(res).M("cleared").IntZ() != 1 {
+		t.Errorf("topic.clear: expecting 1 cleared message: got %v", res)
+	}
+	res, err = conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic + ".status"})
+	if err != nil || ei.N(res).M("retained").IntZ() != 0 {
+		t.Errorf("topic.sub after clear: expecting no retained messages")
+	}
+}
+
+func TestTopicStreamReplay(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	topic := Prefix4 + ".stream.replay" + Suffix
+	offsets := []int64{}
+	for i := 1; i <= 3; i++ {
+		res, err := conn.Exec("topic.pub", map[string]interface{}{"topic": topic, "msg": i})
+		if err != nil {
+			t.Fatalf("topic.pub on stream: %s", err.Error())
+		}
+		offsets = append(offsets, ei.N(res).M("offset").Int64Z())
+	}
+	if offsets[0] <= 0 || offsets[2] <= offsets[1] || offsets[1] <= offsets[0] {
+		t.Fatalf("topic.pub on stream: expecting increasing offsets: got %v", offsets)
+	}
+
+	pipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer pipe.Close()
+	res, err := conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic, "offset": offsets[1]})
+	if err != nil {
+		t.Fatalf("topic.sub with offset: %s", err.Error())
+	}
+	if ei.N(res).M("replayed").IntZ() != 2 {
+		t.Errorf("topic.sub with offset: expecting 2 replayed messages: got %v", res)
+	}
+	if ei.N(res).M("offset").Int64Z() != offsets[2] {
+		t.Errorf("topic.sub with offset: expecting replay up to offset %d: got %v", offsets[2], res)
+	}
+	if _, err = conn.TopicPublish(topic, 4); err != nil {
+		t.Errorf("topic.pub: %s", err.Error())
+	}
+	time.Sleep(time.Millisecond * 100)
+	topicData, err := pipe.TopicRead(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read from topic: %s", err.Error())
+	}
+	if len(topicData.Msgs) != 3 {
+		t.Fatalf("pipe.read from topic: expecting 3 messages: got %d", len(topicData.Msgs))
+	}
+	for i, m := range topicData.Msgs {
+		if ei.N(m.Msg).IntZ() != i+2 {
+			t.Errorf("pipe.read from topic: expecting message %d: got %v", i+2, m.Msg)
+		}
+	}
+
+	if _, err = conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": Prefix4 + ".nostream", "offset": 1}); !IsNexusErrCode(err, nexus.ErrInvalidParams) {
+		t.Errorf("topic.sub with offset out of a stream: expecting ErrInvalidParams")
+	}
+}
+
+func TestTopicQueueGroup(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	topic := Prefix4 + ".group" + Suffix
+	members := []*nexus.Pipe{}
+	for i := 0; i < 2; i++ {
+		pipe, err := conn.PipeCreate()
+		if err != nil {
+			t.Fatalf("pipe.create: %s", err.Error())
+		}
+		defer pipe.Close()
+		if _, err = conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic, "group": "workers"}); err != nil {
+			t.Fatalf("topic.sub with group: %s", err.Error())
+		}
+		members = append(members, pipe)
+	}
+	pipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer pipe.Close()
+	if _, err = conn.TopicSubscribe(pipe, topic); err != nil {
+		t.Fatalf("topic.sub: %s", err.Error())
+	}
+
+	for i := 1; i <= 10; i++ {
+		if _, err = conn.TopicPublish(topic, i); err != nil {
+			t.Errorf("topic.pub: %s", err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	// Every message reaches one member of the group and every regular subscriber
+	topicData, err := pipe.TopicRead(20, time.Second)
+	if err != nil || len(topicData.Msgs) != 10 {
+		t.Errorf("pipe.read from topic: expecting 10 messages on the regular subscriber")
+	}
+	total := 0
+	for _, member := range members {
+		if topicData, err = member.TopicRead(20, time.Millisecond*200); err == nil {
+			total += len(topicData.Msgs)
+		}
+	}
+	if total != 10 {
+		t.Errorf("pipe.read from topic: expecting 10 messages among the group members: got %d", total)
+	}
+
+	// Subscribing again without a group leaves it
+	if _, err = conn.TopicSubscribe(members[0], topic); err != nil {
+		t.Fatalf("topic.sub: %s", err.Error())
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err = conn.TopicPublish(topic, i); err != nil {
+			t.Errorf("topic.pub: %s", err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+	if topicData, err = members[0].TopicRead(20, time.Second); err != nil || len(topicData.Msgs) != 3 {
+		t.Errorf("pipe.read from topic: expecting 3 messages after leaving the group")
+	}
+}
+
+func TestTopicWildcards(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	base := Prefix4 + ".wild" + Suffix
+	spipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer spipe.Close()
+	if _, err = conn.TopicSubscribe(spipe, base+".+.status"); err != nil {
+		t.Fatalf("topic.sub single level wildcard: %s", err.Error())
+	}
+	tpipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer tpipe.Close()
+	if _, err = conn.TopicSubscribe(tpipe, base+".>"); err != nil {
+		t.Fatalf("topic.sub subtree wildcard: %s", err.Error())
+	}
+
+	for _, topic := range []string{base + ".d1.status", base + ".d1.other", base, base + ".d1.status.sub"} {
+		if _, err = conn.TopicPublish(topic, topic); err != nil {
+			t.Errorf("topic.pub: %s", err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	topicData, err := spipe.TopicRead(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read from topic: %s", err.Error())
+	}
+	if len(topicData.Msgs) != 1 || topicData.Msgs[0].Topic != base+".d1.status" {
+		t.Errorf("pipe.read from single level wildcard: expecting only %s: got %+v", base+".d1.status", topicData.Msgs)
+	}
+	topicData, err = tpipe.TopicRead(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read from topic: %s", err.Error())
+	}
+	if len(topicData.Msgs) != 3 {
+		t.Errorf("pipe.read from subtree wildcard: expecting 3 messages without the parent: got %+v", topicData.Msgs)
+	}
+
+	if _, err = conn.TopicUnsubscribe(spipe, base+".+.status"); err != nil {
+		t.Errorf("topic.unsub single level wildcard: %s", err.Error())
+	}
+	conn.TopicPublish(base+".d2.status", 1)
+	time.Sleep(time.Millisecond * 200)
+	if topicData, err = spipe.TopicRead(10, time.Millisecond*200); err == nil && len(topicData.Msgs) != 0 {
+		t.Errorf("pipe.read after topic.unsub: expecting no messages")
+	}
+}
+
+func TestTopicFilter(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	topic := Prefix4 + ".filter" + Suffix
+	pipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer pipe.Close()
+	if _, err = conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic, "filter": "msg.temp >="}); !IsNexusErrCode(err, nexus.ErrInvalidParams) {
+		t.Errorf("topic.sub with invalid filter: expecting ErrInvalidParams")
+	}
+	if _, err = conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic, "filter": strings.Repeat("(", 100) + "true" + strings.Repeat(")", 100)}); !IsNexusErrCode(err, nexus.ErrInvalidParams) {
+		t.Errorf("topic.sub with too deep filter: expecting ErrInvalidParams")
+	}
+	if _, err = conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic, "filter": strings.Repeat("!", 100) + "true"}); !IsNexusErrCode(err, nexus.ErrInvalidParams) {
+		t.Errorf("topic.sub with too deep filter: expecting ErrInvalidParams")
+	}
+	if _, err = conn.Exec("topic.sub", map[string]interface{}{"pipeid": pipe.Id(), "topic": topic, "filter": `msg.temp >= 30 && msg.unit == "C"`}); err != nil {
+		t.Fatalf("topic.sub with filter: %s", err.Error())
+	}
+
+	for _, m := range []map[string]interface{}{{"temp": 20, "unit": "C"}, {"temp": 35, "unit": "C"}, {"temp": 90, "unit": "F"}, {"other": true}} {
+		if _, err = conn.TopicPublish(topic, m); err != nil {
+			t.Errorf("topic.pub: %s", err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+	topicData, err := pipe.TopicRead(10, time.Second)
+	if err != nil {
+		t.Fatalf("pipe.read from topic: %s", err.Error())
+	}
+	if len(topicData.Msgs) != 1 || ei.N(topicData.Msgs[0].Msg).M("temp").IntZ() != 35 {
+		t.Errorf("pipe.read from filtered topic: expecting only the message with temp 35: got %+v", topicData.Msgs)
+	}
+
+	// Subscribing again without a filter drops it
+	if _, err = conn.TopicSubscribe(pipe, topic); err != nil {
+		t.Fatalf("topic.sub: %s", err.Error())
+	}
+	conn.TopicPublish(topic, map[string]interface{}{"temp": 20, "unit": "C"})
+	if topicData, err = pipe.TopicRead(10, time.Second); err != nil || len(topicData.Msgs) != 1 {
+		t.Errorf("pipe.read after dropping the filter: expecting 1 message")
+	}
+}
+
+func TestTopicPublisherMeta(t *testing.T) {
+	conn, err := login(UserA, UserA)
+	if err != nil {
+		t.Fatalf("sys.login userA: %s", err.Error())
+	}
+	defer conn.Close()
+
+	pipe, err := conn.PipeCreate()
+	if err != nil {
+		t.Fatalf("pipe.create: %s", err.Error())
+	}
+	defer pipe.Close()
+	topic := Prefix4 + ".meta" + Suffix
+	hidden := Prefix4 + ".hidden.meta" + Suffix
+	for _, tp := range []string{topic, hidden} {
+		if _, err = conn.TopicSubscribe(pipe, tp); err != nil {
+			t.Fatalf("topic.sub: %s", err.Error())
+		}
+		if _, err = conn.Exec("topic.pub", map[string]interface{}{"topic": tp, "msg": 1, "headers": map[string]interface{}{"trace": "abc"}}); err != nil {
+			t.Errorf("topic.pub with headers: %s", err.Error())
+		}
+	}
+	if _, err = conn.Exec("topic.pub", map[string]interface{}{"topic": topic, "msg": 1, "headers": "bad"}); !IsNexusErrCode(err, nexus.ErrInvalidParams) {
+		t.Errorf("topic.pub with invalid headers: expecting ErrInvalidParams")
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	res, err := conn.Exec("pipe.read", map[string]interface{}{"pipeid": pipe.Id(), "max": 10, "timeout": 1})
+	if err != nil {
+		t.Fatalf("pipe.read: %s", err.Error())
+	}
+	msgs := ei.N(res).M("msgs").SliceZ()
+	if len(msgs) != 2 {
+		t.Fatalf("pipe.read: expecting 2 messages: got %d", len(msgs))
+	}
+	shown, hid := ei.N(msgs[0]).M("msg"), ei.N(msgs[1]).M("msg")
+	if shown.M("user").StringZ() != UserA || shown.M("connid").StringZ() == "" || shown.M("timestamp").StringZ() == "" {
+		t.Errorf("pipe.read: expecting publisher metadata: got %v", shown.RawZ())
+	}
+	if shown.M("headers").M("trace").StringZ() != "abc" {
+		t.Errorf("pipe.read: expecting headers: got %v", shown.RawZ())
+	}
+	if hid.M("user").StringZ() != "" || hid.M("connid").StringZ() != "" || hid.M("timestamp").StringZ() == "" {
+		t.Errorf("pipe.read: expecting hidden publisher: got %v", hid.RawZ())
+	}
+}
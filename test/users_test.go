@@ -1,12 +1,16 @@
 package test
 
 import (
+	"encoding/hex"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jaracil/ei"
 	nexus "github.com/nayarsystems/nxgo/nxcore"
+	"golang.org/x/crypto/scrypt"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
 )
 
 func TestUserCreateFail(t *testing.T) {
@@ -88,6 +92,109 @@ func TestUserSetPass(t *testing.T) {
 	conn2.Close()
 }
 
+func TestUserLoginTwice(t *testing.T) {
+	user := "rehash" + Suffix
+	if _, err := RootSes.UserCreate(user, user); err != nil {
+		t.Fatalf("user.create: %s", err.Error())
+	}
+	defer RootSes.UserDelete(user)
+
+	db, err := r.Connect(r.ConnectOpts{Address: RethinkServer, Database: RethinkDatabase})
+	if err != nil {
+		t.Fatalf("rethinkdb connect: %s", err.Error())
+	}
+	defer db.Close()
+	storedPass := func() string {
+		cur, err := r.Table("users").Get(user).Field("pass").Run(db)
+		if err != nil {
+			t.Fatalf("rethinkdb get user: %s", err.Error())
+		}
+		defer cur.Close()
+		var pass string
+		if err := cur.One(&pass); err != nil {
+			t.Fatalf("rethinkdb get user: %s", err.Error())
+		}
+		return pass
+	}
+
+	// Store the password with the legacy format, a hex scrypt key and a separate salt
+	salt := "00112233445566778899aabbccddeeff"
+	bsalt, _ := hex.DecodeString(salt)
+	key, err := scrypt.Key([]byte(user), bsalt, 16384, 8, 1, 16)
+	if err != nil {
+		t.Fatalf("scrypt: %s", err.Error())
+	}
+	legacy := hex.EncodeToString(key)
+	if _, err := r.Table("users").Get(user).Update(map[string]interface{}{"salt": salt, "pass": legacy}).RunWrite(db); err != nil {
+		t.Fatalf("rethinkdb update user: %s", err.Error())
+	}
+
+	// The first login stores the hash again with the target settings, which must keep working
+	var rehashed string
+	for i := 0; i < 2; i++ {
+		conn, err := login(user, user)
+		if err != nil {
+			t.Fatalf("user.login %d: %s", i, err.Error())
+		}
+		conn.Close()
+		pass := storedPass()
+		if i == 0 {
+			if pass == legacy || !strings.HasPrefix(pass, "$") {
+				t.Errorf("user.login: expecting the legacy hash to be stored again encoded, got %q", pass)
+			}
+			rehashed = pass
+		} else if pass != rehashed {
+			t.Errorf("user.login %d: expecting the hash to be kept, got %q", i, pass)
+		}
+	}
+	if _, err := login(user, UserA); !IsNexusErrCode(err, nexus.ErrPermissionDenied) {
+		t.Errorf("user.login wrong pass: expecting permission denied")
+	}
+}
+
+func TestUserLockout(t *testing.T) {
+	user := "lockout" + Suffix
+	if _, err := RootSes.UserCreate(user, user); err != nil {
+		t.Fatalf("user.create: %s", err.Error())
+	}
+	defer RootSes.UserDelete(user)
+
+	for i := 0; i < 5; i++ {
+		if _, err := login(user, "wrong"); !IsNexusErrCode(err, nexus.ErrPermissionDenied) {
+			t.Fatalf("user.login wrong pass %d: expecting permission denied", i)
+		}
+	}
+	if _, err := login(user, user); !IsNexusErrCode(err, -32008) {
+		t.Fatalf("user.login after failures: expecting locked out error")
+	}
+
+	res, err := RootSes.Exec("user.unlock", map[string]interface{}{"user": user})
+	if err != nil {
+		t.Fatalf("user.unlock: %s", err.Error())
+	}
+	if !ei.N(res).M("unlocked").BoolZ() {
+		t.Errorf("user.unlock: unexpected result %v", res)
+	}
+	conn, err := login(user, user)
+	if err != nil {
+		t.Fatalf("user.login after user.unlock: %s", err.Error())
+	}
+	defer conn.Close()
+
+	// Forget the failures of this test on the remote address too
+	sessions, err := RootSes.Exec("sys.session.list", map[string]interface{}{"prefix": user})
+	if err != nil {
+		t.Fatalf("sys.session.list: %s", err.Error())
+	}
+	remote := ei.N(sessions).S(0).M("sessions").S(0).M("remoteAddress").StringZ()
+	if _, err := RootSes.Exec("user.unlock", map[string]interface{}{"remote": remote}); err != nil {
+		t.Errorf("user.unlock remote: %s", err.Error())
+	}
+	if _, err := conn.Exec("user.unlock", map[string]interface{}{"remote": remote}); !IsNexusErrCode(err, nexus.ErrPermissionDenied) {
+		t.Errorf("user.unlock remote without admin tag: expecting permission denied")
+	}
+}
+
 func TestUserTags(t *testing.T) {
 	sesA, err := login(UserA, UserA)
 	if err != nil {
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jaracil/ei"
 	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
@@ -21,13 +27,333 @@ func topicList(s string) (res []interface{}) {
 	return
 }
 
-func topicPublish(topic string, message interface{}) (int, error) {
-	msg := ei.M{"topic": topic, "msg": message}
-	res, err := r.Table("pipes").
+// Subscriptions with a + label (any single label) or ending with > (any label below, but not the parent)
+func isTopicWildcard(sub string) bool {
+	chunks := strings.Split(sub, ".")
+	for _, c := range chunks {
+		if c == "+" {
+			return true
+		}
+	}
+	return chunks[len(chunks)-1] == ">"
+}
+
+// Return the labels of a subscription before its first wildcard
+func topicLiteralPrefix(sub string) string {
+	chunks := strings.Split(sub, ".")
+	for n, c := range chunks {
+		if c == "+" || c == ">" || c == "*" {
+			return strings.Join(chunks[0:n], ".")
+		}
+	}
+	return sub
+}
+
+// Index key of a wildcard subscription, which must be one of the prefixes of the topics it matches
+func topicWildcardKey(sub string) string {
+	if key := topicLiteralPrefix(sub); key != "" {
+		return key
+	}
+	return "."
+}
+
+func topicMatch(sub string, topic string) bool {
+	if sub == ".*" || sub == topic {
+		return true
+	}
+	subChunks := strings.Split(sub, ".")
+	topicChunks := strings.Split(topic, ".")
+	for n, c := range subChunks {
+		if n == len(subChunks)-1 {
+			switch c {
+			case "*":
+				return len(topicChunks) >= n
+			case ">":
+				return len(topicChunks) > n
+			}
+		}
+		if n >= len(topicChunks) || (c != "+" && c != topicChunks[n]) {
+			return false
+		}
+	}
+	return len(subChunks) == len(topicChunks)
+}
+
+// RE2 equivalent of topicMatch, to match topics on the database
+func topicRegexp(sub string) string {
+	if sub == ".*" {
+		return "^.*$"
+	}
+	chunks := strings.Split(sub, ".")
+	exp := ""
+	for n, c := range chunks {
+		sep := `\.`
+		if n == 0 {
+			sep = ""
+		}
+		switch {
+		case n == len(chunks)-1 && c == "*":
+			return "^" + exp + `(\..+)?$`
+		case n == len(chunks)-1 && c == ">":
+			return "^" + exp + sep + ".+$"
+		case c == "+":
+			exp += sep + `[^.]+`
+		default:
+			exp += sep + regexp.QuoteMeta(c)
+		}
+	}
+	return "^" + exp + "$"
+}
+
+// Stream offset up to which a subscription has been replayed
+type TopicReplay struct {
+	Stream string `gorethink:"stream"`
+	Offset int64  `gorethink:"offset"`
+}
+
+type TopicSubscriber struct {
+	Id       string                 `gorethink:"id"`
+	Subs     []string               `gorethink:"subs"`
+	Groups   map[string]string      `gorethink:"groups"`
+	Filters  map[string]string      `gorethink:"filters"`
+	Replays  map[string]TopicReplay `gorethink:"replays"`
+	Overflow string                 `gorethink:"overflow"`
+}
+
+// Whether the pipe takes every message on topics of list through subscriptions with neither a queue group,
+// a filter nor a replay. Those pipes are written by the plain publication, see topicPlainSubscriber.
+func (s *TopicSubscriber) plain(list map[string]bool) bool {
+	if s.Overflow == OverflowBlock {
+		return false
+	}
+	matched := false
+	for _, sub := range s.Subs {
+		if !list[sub] {
+			continue
+		}
+		_, group := s.Groups[sub]
+		_, filter := s.Filters[sub]
+		_, replay := s.Replays[sub]
+		if group || filter || replay {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// Database equivalent of TopicSubscriber.plain
+func topicPlainSubscriber(p r.Term, list []interface{}) r.Term {
+	return p.Field("overflow").Default("").Ne(OverflowBlock).And(
+		p.Field("subs").SetIntersection(list).Filter(func(s r.Term) interface{} {
+			return p.Field("groups").Default(ei.M{}).HasFields(s).
+				Or(p.Field("filters").Default(ei.M{}).HasFields(s)).
+				Or(p.Field("replays").Default(ei.M{}).HasFields(s))
+		}).IsEmpty())
+}
+
+// Return the pipes a message published on topic must be written to, picking a single member of each queue group.
+// Messages of a durable stream already written by the replay of a subscription are skipped for it. The plain
+// subscribers are left out, as they are written by the plain publication.
+func topicSubscribers(topic string, msg interface{}, stream string, offset int64) ([]interface{}, error) {
+	keys := make([]interface{}, 0)
+	for _, p := range prefixes(topic) {
+		keys = append(keys, p)
+	}
+	cur, err := r.Table("pipes").
 		GetAllByIndex("subs", topicList(topic)...).
-		Update(map[string]interface{}{"msg": r.Literal(msg), "count": r.Row.Field("count").Add(1), "ismsg": true}).
-		RunWrite(db, r.RunOpts{Durability: "soft"})
-	return res.Replaced, err
+		Union(r.Table("pipes").GetAllByIndex("wsubs", keys...)).
+		Pluck("id", "subs", "groups", "filters", "replays", "overflow").
+		Run(db)
+	if err != nil {
+		return nil, err
+	}
+	subscribers := make([]*TopicSubscriber, 0)
+	err = cur.All(&subscribers)
+	cur.Close()
+	if err != nil {
+		return nil, err
+	}
+	list := map[string]bool{}
+	for _, t := range topicList(topic) {
+		list[t.(string)] = true
+	}
+	ids := make([]interface{}, 0, len(subscribers))
+	added := map[string]bool{}
+	direct := map[string]bool{}
+	plain := map[string]bool{}
+	groups := map[string][]string{}
+	for _, sub := range subscribers {
+		if added[sub.Id] {
+			continue
+		}
+		added[sub.Id] = true
+		plain[sub.Id] = sub.plain(list)
+		for _, s := range sub.Subs {
+			if !topicMatch(s, topic) {
+				continue
+			}
+			if rp, ok := sub.Replays[s]; ok && offset > 0 && rp.Stream == stream && offset <= rp.Offset {
+				continue
+			}
+			if expr, ok := sub.Filters[s]; ok {
+				if f, err := topicFilters.Get(expr); err != nil || !f.Match(topic, msg) {
+					continue
+				}
+			}
+			if group, ok := sub.Groups[s]; ok {
+				key := s + "|" + group
+				groups[key] = append(groups[key], sub.Id)
+			} else {
+				direct[sub.Id] = true
+			}
+		}
+		if direct[sub.Id] && !plain[sub.Id] {
+			ids = append(ids, sub.Id)
+		}
+	}
+	for _, members := range groups {
+		member := members[rand.Intn(len(members))]
+		if !direct[member] {
+			direct[member] = true
+			ids = append(ids, member)
+		}
+	}
+	return ids, nil
+}
+
+// Write msg on the plain subscribers of topic with a single indexed update, returning how many were written
+// and whether there are other subscribers left, which need topicSubscribers
+func topicPublishPlain(topic string, msg ei.M) (int, bool, error) {
+	list := topicList(topic)
+	keys := make([]interface{}, 0)
+	for _, p := range prefixes(topic) {
+		keys = append(keys, p)
+	}
+	cur, err := pipesWrite(r.Table("pipes").GetAllByIndex("subs", list...), msg, func(p r.Term) interface{} {
+		return r.Branch(topicPlainSubscriber(p, list), pipeMsgUpdate(p, msg), map[string]interface{}{})
+	}).
+		Do(func(res r.Term) interface{} {
+			return res.Merge(ei.M{"wildcards": r.Table("pipes").GetAllByIndex("wsubs", keys...).Count()})
+		}).
+		Run(db, r.RunOpts{Durability: "soft"})
+	if err != nil {
+		return 0, false, err
+	}
+	res := ei.M{}
+	err = cur.One(&res)
+	cur.Close()
+	if err != nil {
+		return 0, false, err
+	}
+	return ei.N(res).M("replaced").IntZ(), ei.N(res).M("unchanged").IntZ() > 0 || ei.N(res).M("wildcards").IntZ() > 0, nil
+}
+
+// Publish message to the subscribers of topic. Extra fields are added to the message envelope
+func topicPublish(ctx context.Context, topic string, message interface{}, extra ei.M) (int, error) {
+	msg := ei.M{"topic": topic, "msg": message}
+	for k, v := range extra {
+		msg[k] = v
+	}
+	stream, offset := "", ei.N(extra).M("offset").Int64Z()
+	if offset > 0 {
+		stream = topicStream(topic)
+	}
+	sent, more, err := topicPublishPlain(topic, msg)
+	if err != nil || !more {
+		return sent, err
+	}
+	ids, err := topicSubscribers(topic, message, stream, offset)
+	if err != nil {
+		return sent, err
+	}
+	n, err := pipesPublish(ctx, ids, msg)
+	return sent + n, err
+}
+
+// Write msg on every pipe of ids. Block overflow pipes are written one by one, so the
+// publisher waits for room on the full ones
+func pipesPublish(ctx context.Context, ids []interface{}, msg ei.M) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := pipesWrite(r.Table("pipes").GetAll(ids...), msg, func(p r.Term) interface{} {
+		return r.Branch(p.Field("overflow").Default("").Eq(OverflowBlock), map[string]interface{}{}, pipeMsgUpdate(p, msg))
+	}).RunWrite(db, r.RunOpts{Durability: "soft"})
+	if err != nil || res.Unchanged == 0 {
+		return res.Replaced, err
+	}
+	cur, err := r.Table("pipes").
+		GetAll(ids...).
+		Filter(r.Row.Field("overflow").Default("").Eq(OverflowBlock)).
+		Field("id").
+		Run(db)
+	if err != nil {
+		return res.Replaced, err
+	}
+	blocked := make([]string, 0)
+	err = cur.All(&blocked)
+	cur.Close()
+	if err != nil {
+		return res.Replaced, err
+	}
+	return res.Replaced + pipesWaitWrite(ctx, blocked, msg), nil
+}
+
+// Write msg on block overflow pipes at once, waiting for room on the full ones
+func pipesWaitWrite(ctx context.Context, ids []string, msg ei.M) int {
+	var sent int64
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(pipeid string) {
+			defer wg.Done()
+			if code, _ := pipeWrite(ctx, pipeid, msg); code == ErrNoError {
+				atomic.AddInt64(&sent, 1)
+			}
+		}(id)
+	}
+	wg.Wait()
+	return int(sent)
+}
+
+// Prefixes below which the publishers of topics are hidden
+var hiddenPublishers = map[string]bool{}
+
+// Parse the --hidepublisher options
+func loadHiddenPublishers() error {
+	for _, v := range opts.HidePublisher {
+		prefix := strings.Trim(strings.ToLower(v), ". ")
+		if prefix == "" {
+			return fmt.Errorf("invalid hidden publisher prefix %q", v)
+		}
+		hiddenPublishers[prefix] = true
+	}
+	return nil
+}
+
+// Return who and when is publishing on topic, unless publishers are hidden below it
+func (nc *NexusConn) topicPublisherMeta(topic string) ei.M {
+	meta := ei.M{"timestamp": time.Now().UTC()}
+	if len(hiddenPublishers) > 0 {
+		for _, p := range prefixes(topic) {
+			if hiddenPublishers[p] {
+				return meta
+			}
+		}
+	}
+	meta["user"] = nc.user.User
+	meta["connid"] = nc.connId
+	return meta
+}
+
+// Write a topic message envelope on a single pipe
+func topicSendToPipe(ctx context.Context, pipeid string, msg ei.M) (int, error) {
+	code, err := pipeWrite(ctx, pipeid, msg)
+	if code != ErrNoError {
+		return 0, err
+	}
+	return 1, nil
 }
 
 func (nc *NexusConn) handleTopicReq(req *JsonRpcReq) {
@@ -38,23 +364,75 @@ func (nc *NexusConn) handleTopicReq(req *JsonRpcReq) {
 			req.Error(ErrInvalidParams, "pipeid", nil)
 			return
 		}
+		if isSharedPipe(pipeid) {
+			req.Error(ErrInvalidPipe, "shared pipes can't subscribe to topics", nil)
+			return
+		}
 		topic, err := ei.N(req.Params).M("topic").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
 		if err != nil {
 			req.Error(ErrInvalidParams, "topic", nil)
 			return
 		}
+		// Wildcard subscriptions need permission on everything they can match
 		tags := nc.getTags(topic)
+		if isTopicWildcard(topic) {
+			tags = nc.getTags(topicLiteralPrefix(topic))
+		}
 		if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
 			req.Error(ErrPermissionDenied, "", nil)
 			return
 		}
+		wsubs := r.Row.Field("wsubs").Default(ei.M{})
+		if isTopicWildcard(topic) {
+			wsubs = wsubs.Merge(r.Object(topic, topicWildcardKey(topic)))
+		}
+		groups := r.Row.Field("groups").Default(ei.M{}).Without(topic)
+		filters := r.Row.Field("filters").Default(ei.M{}).Without(topic)
+		var filter *TopicFilter
+		if expr := ei.N(req.Params).M("filter").StringZ(); expr != "" {
+			if filter, err = topicFilters.Get(expr); err != nil {
+				req.Error(ErrInvalidParams, "filter: "+err.Error(), nil)
+				return
+			}
+			filters = filters.Merge(r.Object(topic, expr))
+		}
+		if group := ei.N(req.Params).M("group").StringZ(); group != "" {
+			groups = groups.Merge(r.Object(topic, group))
+		}
+		var replay interface{}
+		stream := ""
+		if ei.N(req.Params).HasKeyZ("offset") || ei.N(req.Params).HasKeyZ("since") {
+			stream = topicStream(topicLiteralPrefix(topic))
+			if stream == "" {
+				req.Error(ErrInvalidParams, "topic is not on a durable stream", nil)
+				return
+			}
+			if since, err := ei.N(req.Params).M("since").Float64(); err == nil {
+				replay = time.Unix(0, int64(since*float64(time.Second)))
+			} else {
+				replay = ei.N(req.Params).M("offset").Int64Z()
+			}
+		}
+		// The replay covers the stream up to the offset read by the subscribing query, later messages
+		// are delivered live and the earlier ones still being published are skipped
+		replays := r.Row.Field("replays").Default(ei.M{}).Without(topic)
+		if replay != nil {
+			replays = replays.Merge(r.Object(topic, ei.M{
+				"stream": stream,
+				"offset": r.Table("streams").Get(stream).Field("offset").Default(0),
+			}))
+		}
 		res, err := r.Table("pipes").
 			Get(pipeid).
 			Update(map[string]interface{}{
-				"subs":  r.Row.Field("subs").Default(ei.S{}).SetInsert(topic),
-				"ismsg": false,
-				"msg":   nil,
-			}).
+				"subs":    r.Row.Field("subs").Default(ei.S{}).SetInsert(topic),
+				"wsubs":   r.Literal(wsubs),
+				"groups":  r.Literal(groups),
+				"filters": r.Literal(filters),
+				"replays": r.Literal(replays),
+				"ismsg":   false,
+				"msg":     nil,
+			}, r.UpdateOpts{NonAtomic: true, ReturnChanges: "always"}).
 			RunWrite(db, r.RunOpts{Durability: "hard"})
 		if err != nil {
 			req.Error(ErrInternal, "", nil)
@@ -64,7 +442,30 @@ func (nc *NexusConn) handleTopicReq(req *JsonRpcReq) {
 			req.Error(ErrInvalidPipe, "", nil)
 			return
 		}
-		req.Result(map[string]interface{}{"ok": true})
+		retained, err := topicSendRetained(nc.context, pipeid, topic, filter)
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		if replay == nil {
+			req.Result(map[string]interface{}{"ok": true, "retained": retained})
+			return
+		}
+		upto := int64(0)
+		if len(res.Changes) > 0 {
+			upto = ei.N(res.Changes[0].NewValue).M("replays").M(topic).M("offset").Int64Z()
+		}
+		var replayed int
+		if since, ok := replay.(time.Time); ok {
+			replayed, err = streamReplay(nc.context, pipeid, stream, topic, filter, 0, &since, upto)
+		} else {
+			replayed, err = streamReplay(nc.context, pipeid, stream, topic, filter, replay.(int64), nil, upto)
+		}
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		req.Result(map[string]interface{}{"ok": true, "retained": retained, "replayed": replayed, "offset": upto})
 	case "topic.unsub":
 		pipeid, err := ei.N(req.Params).M("pipeid").String()
 		if err != nil {
@@ -84,9 +485,13 @@ func (nc *NexusConn) handleTopicReq(req *JsonRpcReq) {
 		res, err := r.Table("pipes").
 			Get(pipeid).
 			Update(map[string]interface{}{
-				"subs":  r.Row.Field("subs").Default(ei.S{}).Difference(ei.S{topic}),
-				"ismsg": false,
-				"msg":   nil,
+				"subs":    r.Row.Field("subs").Default(ei.S{}).Difference(ei.S{topic}),
+				"wsubs":   r.Literal(r.Row.Field("wsubs").Default(ei.M{}).Without(topic)),
+				"groups":  r.Literal(r.Row.Field("groups").Default(ei.M{}).Without(topic)),
+				"filters": r.Literal(r.Row.Field("filters").Default(ei.M{}).Without(topic)),
+				"replays": r.Literal(r.Row.Field("replays").Default(ei.M{}).Without(topic)),
+				"ismsg":   false,
+				"msg":     nil,
 			}).
 			RunWrite(db, r.RunOpts{Durability: "hard"})
 		if err != nil {
@@ -117,12 +522,55 @@ func (nc *NexusConn) handleTopicReq(req *JsonRpcReq) {
 			return
 		}
 
-		sent, err := topicPublish(topic, msg)
+		extra := nc.topicPublisherMeta(topic)
+		if headers, err := ei.N(req.Params).M("headers").MapStr(); err == nil {
+			extra["headers"] = headers
+		} else if ei.N(req.Params).HasKeyZ("headers") {
+			req.Error(ErrInvalidParams, "headers", nil)
+			return
+		}
+		if ei.N(req.Params).M("retain").BoolZ() {
+			if err := topicRetain(topic, msg, extra); err != nil {
+				req.Error(ErrInternal, "", nil)
+				return
+			}
+		}
+		if stream := topicStream(topic); stream != "" {
+			offset, err := streamAppend(stream, topic, msg, extra)
+			if err != nil {
+				req.Error(ErrInternal, "", nil)
+				return
+			}
+			extra["offset"] = offset
+		}
+		sent, err := topicPublish(nc.context, topic, msg, extra)
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		result := map[string]interface{}{"ok": true, "sent": sent}
+		if offset, ok := extra["offset"]; ok {
+			result["offset"] = offset
+		}
+		req.Result(result)
+
+	case "topic.clear":
+		topic, err := ei.N(req.Params).M("topic").Lower().F(checkRegexp, _prefixRegexp).F(checkNotEmptyLabels).String()
+		if err != nil {
+			req.Error(ErrInvalidParams, "topic", nil)
+			return
+		}
+		tags := nc.getTags(topicLiteralPrefix(topic))
+		if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+			req.Error(ErrPermissionDenied, "", nil)
+			return
+		}
+		cleared, err := topicUnretain(topic)
 		if err != nil {
 			req.Error(ErrInternal, "", nil)
 			return
 		}
-		req.Result(map[string]interface{}{"ok": true, "sent": sent})
+		req.Result(map[string]interface{}{"ok": true, "cleared": cleared})
 
 	case "topic.list":
 		prefix, depth, filter, limit, skip := getListParams(req.Params)
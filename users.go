@@ -36,7 +36,7 @@ func (nc *NexusConn) handleUserReq(req *JsonRpcReq) {
 			req.Error(ErrInvalidParams, "user", nil)
 			return
 		}
-		pass, err := ei.N(req.Params).M("pass").F(checkLen, _passwordMinLen, _passwordMaxLen).String()
+		pass, err := ei.N(req.Params).M("pass").F(checkLen, _passwordMinLen, passMaxLen()).String()
 		if err != nil {
 			req.Error(ErrInvalidParams, "pass", nil)
 			return
@@ -46,8 +46,8 @@ func (nc *NexusConn) handleUserReq(req *JsonRpcReq) {
 			req.Error(ErrPermissionDenied, "", nil)
 			return
 		}
-		ud := UserData{User: user, Salt: safeId(16), Tags: map[string]map[string]interface{}{}, Templates: []string{}, MaxSessions: DEFAULT_MAX_SESSIONS, Disabled: false, CreatedAt: time.Now()}
-		ud.Pass, err = HashPass(pass, ud.Salt)
+		ud := UserData{User: user, Tags: map[string]map[string]interface{}{}, Templates: []string{}, MaxSessions: DEFAULT_MAX_SESSIONS, Disabled: false, CreatedAt: time.Now()}
+		ud.Pass, err = EncodePass(pass)
 		if err != nil {
 			req.Error(ErrInternal, "", nil)
 			return
@@ -308,7 +308,7 @@ func (nc *NexusConn) handleUserReq(req *JsonRpcReq) {
 			req.Error(ErrInvalidParams, "user", nil)
 			return
 		}
-		pass, err := ei.N(req.Params).M("pass").F(checkLen, _passwordMinLen, _passwordMaxLen).String()
+		pass, err := ei.N(req.Params).M("pass").F(checkLen, _passwordMinLen, passMaxLen()).String()
 		if err != nil {
 			req.Error(ErrInvalidParams, "pass", nil)
 			return
@@ -327,13 +327,12 @@ func (nc *NexusConn) handleUserReq(req *JsonRpcReq) {
 			}
 		}
 
-		salt := safeId(16)
-		hp, err := HashPass(pass, salt)
+		hp, err := EncodePass(pass)
 		if err != nil {
 			req.Error(ErrInternal, "", nil)
 			return
 		}
-		res, err := r.Table("users").Get(user).Update(map[string]interface{}{"salt": salt, "pass": hp}).RunWrite(db, r.RunOpts{Durability: "hard"})
+		res, err := r.Table("users").Get(user).Update(map[string]interface{}{"salt": r.Literal(), "pass": hp}).RunWrite(db, r.RunOpts{Durability: "hard"})
 		if err != nil {
 			req.Error(ErrInternal, "", nil)
 			return
@@ -482,6 +481,44 @@ func (nc *NexusConn) handleUserReq(req *JsonRpcReq) {
 		}
 		nc.userSetParam(req, param, "disabled")
 
+	case "user.unlock":
+		user := ei.N(req.Params).M("user").Lower().StringZ()
+		remote := ei.N(req.Params).M("remote").StringZ()
+		if user == "" && remote == "" {
+			req.Error(ErrInvalidParams, "user or remote", nil)
+			return
+		}
+		keys := make([]interface{}, 0)
+		if user != "" {
+			tags := nc.getTags(user)
+			if !(ei.N(tags).M("@"+req.Method).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+				req.Error(ErrPermissionDenied, "", nil)
+				return
+			}
+			keys = append(keys, loginKey(LoginUser, user))
+		}
+		if remote != "" {
+			// Remote addresses are shared by every user
+			if !ei.N(nc.getTags(".")).M("@admin").BoolZ() {
+				req.Error(ErrPermissionDenied, "", nil)
+				return
+			}
+			keys = append(keys, loginKey(LoginAddr, remoteHost(remote)))
+		}
+		res, err := r.Table("logins").GetAll(keys...).Delete().RunWrite(db, r.RunOpts{Durability: "hard"})
+		if err != nil {
+			req.Error(ErrInternal, "", nil)
+			return
+		}
+		if res.Deleted > 0 {
+			hook("user", user, nc.user.User, ei.M{
+				"action": "unlock",
+				"user":   user,
+				"remote": remote,
+			})
+		}
+		req.Result(ei.M{"ok": true, "unlocked": res.Deleted > 0})
+
 	default:
 		req.Error(ErrMethodNotFound, "", nil)
 	}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jaracil/ei"
+	. "github.com/jaracil/nexus/log"
+	"github.com/sirupsen/logrus"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v3"
+)
+
+// Pipes watch the changes of locks and keys below a prefix. Their watches are kept on
+// the pipe row as "<kind>|<prefix>" strings, and the master node writes the events on them.
+// Only the master node follows the changes, so the ones happening while the master changes are lost.
+
+const (
+	WatchLocks = "locks"
+	WatchKv    = "kv"
+)
+
+type WatchFeed struct {
+	Kind string                 `gorethink:"kind"`
+	Old  map[string]interface{} `gorethink:"old_val"`
+	New  map[string]interface{} `gorethink:"new_val"`
+}
+
+func watchKey(kind string, prefix string) string {
+	return kind + "|" + prefix
+}
+
+// Return whether the row had a ttl which has already expired
+func watchExpired(row map[string]interface{}) bool {
+	expires, ok := row["expires"].(time.Time)
+	return ok && !expires.After(time.Now())
+}
+
+// Turn a change of the locks table into a watch event
+func watchLockEvent(old map[string]interface{}, new map[string]interface{}) (string, ei.M) {
+	event := ""
+	row := new
+	switch {
+	case old == nil:
+		event = "acquired"
+	case new == nil:
+		event = "released"
+		if watchExpired(old) {
+			event = "expired"
+		}
+		row = old
+	default:
+		before, after := len(ei.N(old).M("owners").SliceZ()), len(ei.N(new).M("owners").SliceZ())
+		switch {
+		case after > before:
+			event = "acquired"
+		case after < before:
+			event = "released"
+			if watchExpired(old) {
+				event = "expired"
+			}
+		default:
+			event = "refreshed"
+		}
+	}
+	msg := ei.M{"event": event, "lock": row["id"]}
+	for _, k := range []string{"owner", "mode", "owners", "capacity", "expires"} {
+		if v, ok := row[k]; ok {
+			msg[k] = v
+		}
+	}
+	return ei.N(row).M("id").StringZ(), msg
+}
+
+// Turn a change of the kv table into a watch event. Deleted keys leave a tombstone row
+func watchKvEvent(old map[string]interface{}, new map[string]interface{}) (string, ei.M) {
+	if new == nil || ei.N(new).M("deleted").BoolZ() {
+		event := "deleted"
+		if watchExpired(old) {
+			event = "expired"
+		}
+		return ei.N(old).M("id").StringZ(), ei.M{"event": event, "key": old["id"], "version": old["version"]}
+	}
+	msg := ei.M{"event": "updated", "key": new["id"], "value": new["value"], "version": new["version"]}
+	if expires, ok := new["expires"]; ok {
+		msg["expires"] = expires
+	}
+	return ei.N(new).M("id").StringZ(), msg
+}
+
+// Write an event on the pipes watching name. The watching pipes are looked up by the same query writing on them.
+// Full block overflow pipes drop the event, as waiting for room would hold back the events of every other watch.
+func watchPublish(kind string, name string, msg ei.M) (int, error) {
+	keys := make([]interface{}, 0)
+	for _, p := range prefixes(name) {
+		keys = append(keys, watchKey(kind, p))
+	}
+	msg["watch"] = kind
+	msg["timestamp"] = time.Now().UTC()
+	ids := r.Table("pipes").
+		GetAllByIndex("watches", keys...).
+		Field("id").
+		Distinct()
+	res, err := pipesWrite(r.Table("pipes").GetAll(r.Args(ids)), msg, func(p r.Term) interface{} {
+		return pipeMsgUpdate(p, msg)
+	}).RunWrite(db, r.RunOpts{Durability: "soft"})
+	return res.Replaced, err
+}
+
+// Cancel the watch feed once this node is no longer the master
+func watchMaster(ctx context.Context, cancel context.CancelFunc) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if !isMasterNode() {
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Publish the changes of locks and keys to their watchers, while this node is the master
+func watchTrack() {
+	defer exit("watch change-feed error")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for retry := 0; retry < 10; {
+		if !isMasterNode() {
+			select {
+			case <-tick.C:
+				continue
+			case <-mainContext.Done():
+				return
+			}
+		}
+		ctx, cancel := context.WithCancel(mainContext)
+		go watchMaster(ctx, cancel)
+		iter, err := r.Table("locks").
+			Changes(r.ChangesOpts{Squash: false}).
+			Merge(ei.M{"kind": WatchLocks}).
+			Union(r.Table("kv").
+				Changes(r.ChangesOpts{Squash: false}).
+				Merge(ei.M{"kind": WatchKv})).
+			Run(db, r.RunOpts{Context: ctx})
+		if err != nil {
+			cancel()
+			if mainContext.Err() != nil {
+				return
+			}
+			Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Errorf("Error opening watchTrack iterator")
+			retry++
+			time.Sleep(time.Second)
+			continue
+		}
+		retry = 0
+		for {
+			wf := &WatchFeed{}
+			if !iter.Next(wf) {
+				if ctx.Err() == nil {
+					Log.WithFields(logrus.Fields{
+						"error": iter.Err().Error(),
+					}).Errorf("Error processing watchTrack feed")
+					retry++
+				}
+				iter.Close()
+				break
+			}
+			var name string
+			var msg ei.M
+			if wf.Kind == WatchKv {
+				name, msg = watchKvEvent(wf.Old, wf.New)
+			} else {
+				name, msg = watchLockEvent(wf.Old, wf.New)
+			}
+			if _, err := watchPublish(wf.Kind, name, msg); err != nil {
+				Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Errorf("Error publishing watch event")
+			}
+		}
+		cancel()
+	}
+}
+
+// Handle the watch and unwatch methods of the sync and kv APIs
+func (nc *NexusConn) handleWatchReq(req *JsonRpcReq, kind string, listMethod string, watch bool) {
+	pipeid, err := ei.N(req.Params).M("pipeid").String()
+	if err != nil {
+		req.Error(ErrInvalidParams, "pipeid", nil)
+		return
+	}
+	if isSharedPipe(pipeid) {
+		req.Error(ErrInvalidPipe, "shared pipes can't watch", nil)
+		return
+	}
+	prefix := getPrefixParam(req.Params)
+	tags := nc.getTags(prefix)
+	if !(ei.N(tags).M("@"+listMethod).BoolZ() || ei.N(tags).M("@admin").BoolZ()) {
+		req.Error(ErrPermissionDenied, "", nil)
+		return
+	}
+	if prefix == "" {
+		prefix = "."
+	}
+	watches := r.Row.Field("watches").Default(ei.S{})
+	if watch {
+		watches = watches.SetInsert(watchKey(kind, prefix))
+	} else {
+		watches = watches.Difference(ei.S{watchKey(kind, prefix)})
+	}
+	res, err := r.Table("pipes").
+		Get(pipeid).
+		Update(map[string]interface{}{"watches": watches, "ismsg": false, "msg": nil}).
+		RunWrite(db, r.RunOpts{Durability: "hard"})
+	if err != nil {
+		req.Error(ErrInternal, "", nil)
+		return
+	}
+	if res.Unchanged == 0 && res.Replaced == 0 {
+		req.Error(ErrInvalidPipe, "", nil)
+		return
+	}
+	req.Result(ei.M{"ok": true})
+}